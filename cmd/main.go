@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"github.com/jc-lab/docker-registry-importer/common"
 	"github.com/jc-lab/docker-registry-importer/exporter"
 	"github.com/jc-lab/docker-registry-importer/importer"
-	"github.com/jc-lab/docker-registry-importer/internal/registry"
-	"golang.org/x/net/proxy"
+	"github.com/jc-lab/docker-registry-importer/pkg/discover"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/jc-lab/docker-registry-importer/pkg/record"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
 	"log"
-	"net"
-	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 )
 
 func main() {
@@ -19,61 +24,386 @@ func main() {
 
 	flags.IsImport = flag.Bool("import", false, "import")
 	flags.IsExport = flag.Bool("export", false, "export")
+	flags.IsServe = flag.Bool("serve", false, "serve the --file archive as a read-only registry")
+	flags.Listen = flag.String("listen", ":5000", "address the --serve registry listens on")
+	flags.TLSCert = flag.String("tls-cert", "", "certificate of the --serve registry, which then uses HTTPS")
+	flags.TLSKey = flag.String("tls-key", "", "certificate key of the --serve registry")
+	flags.IsRecord = flag.Bool("record", false, "run a pull-through registry on --listen, recording the images pulled into --record-file")
+	flags.RecordFile = flag.String("record-file", "", "recording of --record, exported with --export when no image is given")
+	flags.IsRewriteManifests = flag.Bool("rewrite-manifests", false, "point the images of the Kubernetes manifests given as arguments at the import destination")
+	flags.Output = flag.String("output", "", "directory the rewritten manifests are written to (default: stdout)")
+	flags.InPlace = flag.Bool("in-place", false, "rewrite the manifests in place")
+	flags.Pin = flag.Bool("pin", false, "pin the rewritten images by their digest in the --file archive")
 	flags.File = flag.String("file", "", "tar file to import")
-	flags.Url = flag.String("url", "", "repository address")
+	flag.Var(&flags.Url, "url", "registry address, with or without scheme (repeatable)")
 	flags.Username = flag.String("username", "", "registry username")
 	flags.Password = flag.String("password", "", "registry password")
-	flags.Proxy = flag.String("proxy", "", "socks5 proxy")
+	flags.Proxy = flag.String("proxy", "", "proxy for every registry: http://, https:// or socks5:// URL, host:port of a socks5 proxy, or direct (default: HTTP_PROXY, HTTPS_PROXY and NO_PROXY)")
+	flags.CACert = flag.String("ca-cert", "", "CA bundle trusted for the --url registries")
+	flags.ClientCert = flag.String("client-cert", "", "client certificate for the --url registries")
+	flags.ClientKey = flag.String("client-key", "", "client certificate key for the --url registries")
+	flags.MinTLSVersion = flag.String("tls-min-version", "", "minimum TLS version for the --url registries: 1.0, 1.1, 1.2 or 1.3")
+	flags.Insecure = flag.Bool("insecure", false, "skip TLS certificate verification of the --url registries")
+	flag.Var(&flags.InsecureRegistries, "insecure-registry", "registry host, host:port or CIDR allowed to use plain HTTP and unverified TLS (repeatable)")
 	flags.IncludeRepoName = flag.Bool("include-repo-name", false, "includeRepoName")
+	flags.RouteByRegistry = flag.Bool("route-by-registry", false, "route the first path segment of imported repositories to the registries in the config routes")
 	flags.ConfigFile = flag.String("config", "", "config")
-	flags.CacheDir = flag.String("cache-dir", "", "cache directory for export")
+	flag.Var(&flags.Discover, "discover", "Kubernetes YAML file, Helm chart, compose file, Dockerfile or directory whose images are exported (repeatable)")
+	flags.CacheDir = flag.String("cache-dir", "", "cache directory for export and record")
+	flags.RewritePrefix = flag.String("rewrite-prefix", "", "prefix prepended to every imported repository")
+	flag.Var(&flags.RewriteStripPrefix, "rewrite-strip-prefix", "prefix removed from imported repositories (repeatable)")
+	flag.Var(&flags.RewriteRegex, "rewrite-regex", "pattern=replacement applied to imported repositories (repeatable)")
+	flags.RewriteMap = flag.String("rewrite-map", "", "json file mapping source to destination repositories")
+	flags.ReportFile = flag.String("report", "", "file to write the result report to")
+	flags.ReportFormat = flag.String("report-format", "json", "report format: json or junit")
+	flags.BestEffort = flag.Bool("best-effort", false, "exit successfully even if some items failed")
+	flags.Progress = flag.String("progress", "auto", "progress output: auto, tty, json or none")
+	flags.TagPolicy = flag.String("tag-policy", "overwrite", "action when a tag exists with another digest: overwrite, skip, fail or rename")
+	flags.Timeout = flag.Duration("timeout", 0, "time limit of the whole import or export, such as 30m (default: none)")
+	flags.RequestTimeout = flag.Duration("request-timeout", 0, "time limit of every registry request but blob transfers, such as 30s (default: none)")
+
+	flags.LogLevel = flag.String("log-level", "info", "least level of the log entries written: debug, info, warn or error")
+	flags.LogFormat = flag.String("log-format", "text", "log format: text or json")
 
 	flag.Parse()
 	flags.ImageList = flag.Args()
 
+	logLevel, err := logging.ParseLevel(*flags.LogLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger, err := logging.New(nil, logLevel, *flags.LogFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logging.SetDefault(logger)
+
+	if *flags.ReportFormat != "json" && *flags.ReportFormat != "junit" {
+		fatal(errors.New("invalid report format (expected json or junit): " + *flags.ReportFormat))
+	}
+
+	progress, err := common.NewProgress(*flags.Progress)
+	if err != nil {
+		fatal(err)
+	}
+	if progress != nil {
+		log.SetOutput(progress)
+	}
+
 	if flags.ConfigFile != nil && len(*flags.ConfigFile) > 0 {
 		config, err := common.ReadConfig(*flags.ConfigFile)
 		if err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 		flags.Config = config
 	}
 
+	// The first SIGINT or SIGTERM cancels the operation, which then cleans up
+	// its uploads and closes the archive; a second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func(signaled context.Context) {
+		<-signaled.Done()
+		stop()
+	}(ctx)
+	if *flags.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *flags.Timeout)
+		defer cancel()
+	}
+
 	if *flags.IsImport {
-		transport := &http.Transport{
-			DisableKeepAlives: true,
+		rewriter, err := newRewriter(flags)
+		if err != nil {
+			fatal(err)
+		}
+
+		tagPolicy, err := importer.ParseTagPolicy(*flags.TagPolicy)
+		if err != nil {
+			fatal(err)
+		}
+
+		opts := &importer.Options{
+			Rewriter:  rewriter,
+			TagPolicy: tagPolicy,
+			Report:    common.NewReport("import"),
+			Progress:  progress,
+			Observer:  logging.Observer(logger),
+		}
+		if *flags.RouteByRegistry {
+			opts.Destinations, err = newRouteDestinations(ctx, flags)
+		} else {
+			opts.Destinations, err = newDestinations(ctx, flags)
+		}
+		if err != nil {
+			fatal(err)
+		}
+
+		file, err := os.Open(*flags.File)
+		if err != nil {
+			fatal(err)
 		}
+		defer file.Close()
+		opts.Archive = file
 
-		if flags.Proxy != nil && len(*flags.Proxy) > 0 {
-			dialer, err := proxy.SOCKS5("tcp", *flags.Proxy, nil, proxy.Direct)
+		result, err := importer.Import(ctx, opts)
+		progress.Close()
+		if result == nil {
+			fatal(err)
+		}
+		finish(ctx, flags, result.Report)
+	} else if *flags.IsExport {
+		var recording *record.Recording
+		if len(*flags.RecordFile) > 0 {
+			recording, err = record.ReadFile(*flags.RecordFile)
 			if err != nil {
-				log.Fatalln(err)
+				fatal(err)
 			}
-			transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-				return dialer.Dial(network, address)
+		}
+
+		images := flags.ImageList
+		if len(flags.Discover) > 0 {
+			scanner := &discover.Scanner{Observer: logging.Observer(logger)}
+			for _, path := range flags.Discover {
+				if err := scanner.Scan(path); err != nil {
+					fatal(err)
+				}
 			}
+			discovered := scanner.Images()
+			logger.Info("discovered images", "images", len(discovered))
+			images = append(images, discovered...)
 		}
 
-		url := strings.TrimSuffix(*flags.Url, "/")
-		wrappedTransport := registry.WrapTransport(transport, url, *flags.Username, *flags.Password)
-		reg := &registry.Registry{
-			URL: url,
-			Client: &http.Client{
-				Transport: wrappedTransport,
+		file, err := os.OpenFile(*flags.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			fatal(err)
+		}
+		defer file.Close()
+
+		result, err := exporter.Export(ctx, &exporter.Options{
+			Archive: file,
+			Images:  images,
+			NewRegistry: func(ctx context.Context, name string) (*registry.Registry, error) {
+				return newConfiguredRegistry(ctx, flags, name)
 			},
-			Logf: registry.Log,
+			IncludeRepoName: *flags.IncludeRepoName,
+			CacheDir:        *flags.CacheDir,
+			Recording:       recording,
+			Report:          common.NewReport("export"),
+			Progress:        progress,
+			Observer:        logging.Observer(logger),
+		})
+		progress.Close()
+		if result == nil {
+			fatal(err)
+		}
+		if ctx.Err() != nil {
+			logger.Warn("export interrupted, the archive holds the images exported so far", "file", *flags.File)
+		}
+		finish(ctx, flags, result.Report)
+	} else if *flags.IsServe {
+		if err := serve(ctx, flags, logger); err != nil {
+			fatal(err)
+		}
+	} else if *flags.IsRecord {
+		if err := recordProxy(ctx, flags, logger); err != nil {
+			fatal(err)
+		}
+	} else if *flags.IsRewriteManifests {
+		if err := rewriteManifests(ctx, flags, logger); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// fatal logs err and exits with status 1.
+func fatal(err error) {
+	logging.Default().Error(err.Error())
+	os.Exit(1)
+}
+
+// finish writes the report and exits with a non-zero status if any item
+// failed, unless --best-effort is given. An interrupted operation exits with
+// status 130, as shells report a SIGINT.
+func finish(ctx context.Context, flags *common.AppFlags, report *common.Report) {
+	if len(*flags.ReportFile) > 0 {
+		if err := report.WriteFile(*flags.ReportFile, *flags.ReportFormat); err != nil {
+			fatal(err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logging.Default().Error("--timeout exceeded", "timeout", *flags.Timeout)
+			os.Exit(1)
+		}
+		logging.Default().Error("interrupted")
+		os.Exit(130)
+	}
+
+	failed := report.Failed()
+	if failed > 0 {
+		if *flags.BestEffort {
+			logging.Default().Warn("items failed (ignored by --best-effort)", "failed", failed)
+			return
 		}
+		logging.Default().Error("items failed", "failed", failed)
+		os.Exit(1)
+	}
+}
 
-		if err := reg.Ping(); err != nil {
-			log.Fatalln("ping failed: ", err)
+func newRewriter(flags *common.AppFlags) (*common.Rewriter, error) {
+	rewriter := &common.Rewriter{
+		Prefix:      *flags.RewritePrefix,
+		StripPrefix: flags.RewriteStripPrefix,
+	}
+	for _, value := range flags.RewriteRegex {
+		rule, err := common.ParseRewriteRule(value)
+		if err != nil {
+			return nil, err
 		}
+		rewriter.Rules = append(rewriter.Rules, rule)
+	}
+	if len(*flags.RewriteMap) > 0 {
+		mapping, err := common.ReadRewriteMapping(*flags.RewriteMap)
+		if err != nil {
+			return nil, err
+		}
+		rewriter.Mapping = mapping
+	}
+	return rewriter, nil
+}
 
-		ctx := &importer.ImportContext{
+// clientOptions returns the settings of every registry client given on the
+// command line.
+func clientOptions(flags *common.AppFlags) *registry.ClientOptions {
+	options := &registry.ClientOptions{
+		InsecureRegistries: append([]string(nil), flags.InsecureRegistries...),
+		Timeout:            *flags.RequestTimeout,
+	}
+	if flags.Proxy != nil {
+		options.Proxy = *flags.Proxy
+	}
+	return options
+}
+
+// newConfiguredRegistry builds the registry of a Config.Repositories entry,
+// or of the registry host name when there is none.
+func newConfiguredRegistry(ctx context.Context, flags *common.AppFlags, name string) (*registry.Registry, error) {
+	return registry.NewFromConfig(ctx, name, flags.Config, clientOptions(flags))
+}
+
+// newDestinations builds a destination for every --url and every registry
+// listed in the config destinations.
+func newDestinations(ctx context.Context, flags *common.AppFlags) ([]*importer.Destination, error) {
+	var destinations []*importer.Destination
+	options := clientOptions(flags)
+	if flags.Config != nil {
+		options.InsecureRegistries = append(options.InsecureRegistries, flags.Config.InsecureRegistries...)
+	}
+	for _, url := range flags.Url {
+		reg, err := registry.NewFromRepositoryConfig(ctx, url, &common.RepositoryConfig{
+			Username:      *flags.Username,
+			Password:      *flags.Password,
+			CACert:        *flags.CACert,
+			ClientCert:    *flags.ClientCert,
+			ClientKey:     *flags.ClientKey,
+			MinTLSVersion: *flags.MinTLSVersion,
+			Insecure:      *flags.Insecure,
+		}, options)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, &importer.Destination{
+			Name:     reg.URL,
 			Registry: reg,
+		})
+	}
+	if flags.Config != nil {
+		for _, name := range flags.Config.Destinations {
+			reg, err := newConfiguredRegistry(ctx, flags, name)
+			if err != nil {
+				return nil, err
+			}
+			destinations = append(destinations, &importer.Destination{
+				Name:     name,
+				Registry: reg,
+			})
 		}
-		ctx.DoImport(flags)
-	} else if *flags.IsExport {
-		ctx := &exporter.ExportContext{}
-		ctx.DoExport(flags)
 	}
+	if len(destinations) == 0 {
+		return nil, errors.New("no destination registry (use --url or destinations in the config file)")
+	}
+	return destinations, nil
+}
+
+// newRouteDestinations builds one destination per registry referenced by the
+// config routes, each with its own credentials and transport.
+func newRouteDestinations(ctx context.Context, flags *common.AppFlags) ([]*importer.Destination, error) {
+	return routeDestinations(flags, func(name string) (*importer.Destination, error) {
+		reg, err := newConfiguredRegistry(ctx, flags, name)
+		if err != nil {
+			return nil, err
+		}
+		return &importer.Destination{Name: name, Registry: reg}, nil
+	})
+}
+
+// urlRegistryFlags returns the flags given that describe the --url
+// registries.
+func urlRegistryFlags(flags *common.AppFlags) []string {
+	var given []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"--url", len(flags.Url) > 0},
+		{"--username", len(*flags.Username) > 0},
+		{"--password", len(*flags.Password) > 0},
+		{"--ca-cert", len(*flags.CACert) > 0},
+		{"--client-cert", len(*flags.ClientCert) > 0},
+		{"--client-key", len(*flags.ClientKey) > 0},
+		{"--tls-min-version", len(*flags.MinTLSVersion) > 0},
+		{"--insecure", *flags.Insecure},
+	} {
+		if f.set {
+			given = append(given, f.name)
+		}
+	}
+	return given
+}
+
+// routeDestinations groups the config routes by destination registry.
+// newDestination builds the destination of a Config.Repositories key.
+func routeDestinations(flags *common.AppFlags, newDestination func(name string) (*importer.Destination, error)) ([]*importer.Destination, error) {
+	if flags.Config == nil || len(flags.Config.Routes) == 0 {
+		return nil, errors.New("--route-by-registry requires routes in the config file")
+	}
+	if ignored := urlRegistryFlags(flags); len(ignored) > 0 {
+		return nil, errors.New("--route-by-registry takes the registries and their credentials from the config file, not from " + strings.Join(ignored, ", "))
+	}
+
+	var sources []string
+	for source := range flags.Config.Routes {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	byRegistry := make(map[string]*importer.Destination)
+	var destinations []*importer.Destination
+	for _, source := range sources {
+		route := flags.Config.Routes[source]
+		dest := byRegistry[route.Registry]
+		if dest == nil {
+			var err error
+			dest, err = newDestination(route.Registry)
+			if err != nil {
+				return nil, err
+			}
+			dest.Routes = make(map[string]string)
+			byRegistry[route.Registry] = dest
+			destinations = append(destinations, dest)
+		}
+		dest.Routes[source] = route.Prefix
+	}
+	return destinations, nil
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/importer"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+)
+
+// rewriteManifests points the images of the Kubernetes manifests given as
+// arguments at the registries of --url, the config destinations or, with
+// --route-by-registry, the config routes. The manifests are written to
+// stdout, below --output or in place.
+func rewriteManifests(ctx context.Context, flags *common.AppFlags, logger *logging.Logger) error {
+	if len(flags.ImageList) == 0 {
+		return errors.New("--rewrite-manifests requires manifest files or directories")
+	}
+	if *flags.InPlace && len(*flags.Output) > 0 {
+		return errors.New("--in-place and --output are exclusive")
+	}
+	rewriter, err := newRewriter(flags)
+	if err != nil {
+		return err
+	}
+	destinations, err := manifestDestinations(flags)
+	if err != nil {
+		return err
+	}
+	manifestRewriter := &importer.ManifestRewriter{
+		Destinations:    destinations,
+		Rewriter:        rewriter,
+		IncludeRepoName: *flags.IncludeRepoName,
+		Observer:        logging.Observer(logger),
+	}
+	if *flags.Pin {
+		if len(*flags.File) == 0 {
+			return errors.New("--pin requires the imported archive as --file")
+		}
+		file, err := os.Open(*flags.File)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		source, err := copier.OpenArchiveSource(file)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		manifestRewriter.Archive = source
+	}
+
+	stdout := !*flags.InPlace && len(*flags.Output) == 0
+	written := 0
+	for _, root := range flags.ImageList {
+		files, err := manifestFiles(root)
+		if err != nil {
+			return err
+		}
+		for _, name := range files {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			out, count, err := manifestRewriter.Rewrite(ctx, name, data)
+			if err != nil {
+				if name == root {
+					return err
+				}
+				logger.Warn("skipped manifest", "file", name, "error", err)
+				continue
+			}
+			logger.Info("rewrote manifest", "file", name, "images", count)
+
+			switch {
+			case stdout:
+				if written > 0 && !bytes.HasPrefix(out, []byte("---")) {
+					fmt.Fprintln(os.Stdout, "---")
+				}
+				os.Stdout.Write(out)
+				if len(out) > 0 && out[len(out)-1] != '\n' {
+					fmt.Fprintln(os.Stdout)
+				}
+			case *flags.InPlace:
+				if count > 0 {
+					if err := writeManifest(name, out); err != nil {
+						return err
+					}
+				}
+			default:
+				relative := filepath.Base(name)
+				if name != root {
+					if relative, err = filepath.Rel(root, name); err != nil {
+						return err
+					}
+				}
+				target := filepath.Join(*flags.Output, relative)
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+					return err
+				}
+				if err := writeManifest(target, out); err != nil {
+					return err
+				}
+			}
+			written++
+		}
+	}
+	return nil
+}
+
+// writeManifest replaces the file name with data, keeping its mode.
+func writeManifest(name string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+// manifestFiles returns root, or the YAML and JSON files below the
+// directory root, sorted, hidden directories and Helm charts excepted.
+func manifestFiles(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+	var files []string
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if name == root {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(name, "Chart.yaml")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, name)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// manifestDestinations returns the registries images are pointed at, named
+// by host.
+func manifestDestinations(flags *common.AppFlags) ([]*importer.Destination, error) {
+	if *flags.RouteByRegistry {
+		return routeDestinations(flags, func(name string) (*importer.Destination, error) {
+			return &importer.Destination{Name: configuredRegistryHost(flags, name)}, nil
+		})
+	}
+
+	var destinations []*importer.Destination
+	for _, url := range flags.Url {
+		destinations = append(destinations, &importer.Destination{Name: registry.Host(url)})
+	}
+	if flags.Config != nil {
+		for _, name := range flags.Config.Destinations {
+			destinations = append(destinations, &importer.Destination{Name: configuredRegistryHost(flags, name)})
+		}
+	}
+	if len(destinations) == 0 {
+		return nil, errors.New("no destination registry (use --url or destinations in the config file)")
+	}
+	return destinations, nil
+}
+
+// configuredRegistryHost returns the host of a Config.Repositories entry,
+// that of its endpoint if it has one.
+func configuredRegistryHost(flags *common.AppFlags, name string) string {
+	if flags.Config != nil {
+		if repoConfig := flags.Config.Repositories[name]; repoConfig != nil && len(repoConfig.Endpoint) > 0 {
+			return registry.Host(repoConfig.Endpoint)
+		}
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/jc-lab/docker-registry-importer/pkg/record"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/jc-lab/docker-registry-importer/pkg/server"
+)
+
+// recordProxy runs a pull-through registry on --listen, recording what
+// clients pull into --record-file, until ctx is cancelled. An existing
+// recording is appended to.
+func recordProxy(ctx context.Context, flags *common.AppFlags, logger *logging.Logger) error {
+	if len(*flags.RecordFile) == 0 {
+		return errors.New("--record requires --record-file")
+	}
+	recording, err := record.ReadFile(*flags.RecordFile)
+	if errors.Is(err, os.ErrNotExist) {
+		recording = nil
+	} else if err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	registries := make(map[string]*registry.Registry)
+	proxy := record.NewProxy(recording)
+	proxy.Registry = func(c context.Context, name string) (*registry.Registry, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if reg := registries[name]; reg != nil {
+			return reg, nil
+		}
+		reg, err := newConfiguredRegistry(c, flags, name)
+		if err != nil {
+			return nil, err
+		}
+		registries[name] = reg
+		return reg, nil
+	}
+	proxy.CacheDir = *flags.CacheDir
+	proxy.File = *flags.RecordFile
+	proxy.Observer = logging.Observer(logger)
+
+	handler := &server.Server{Backend: proxy, Logger: logger, Namespaces: true}
+	err = listenAndServe(ctx, flags, logger, handler, "recording pulls", "file", *flags.RecordFile, "cache", *flags.CacheDir)
+	recording = proxy.Recording()
+	logger.Info("recorded", "images", len(recording.ImageNames()), "manifests", len(recording.Manifests), "blobs", len(recording.Blobs))
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/jc-lab/docker-registry-importer/pkg/server"
+)
+
+// serve serves the --file archive as a read-only registry on --listen until
+// ctx is cancelled.
+func serve(ctx context.Context, flags *common.AppFlags, logger *logging.Logger) error {
+	if len(*flags.File) == 0 {
+		return errors.New("--serve requires --file")
+	}
+
+	file, err := os.Open(*flags.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	source, err := copier.OpenArchiveSource(file)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// Archives exported with --include-repo-name name the registry of every
+	// repository, which containerd mirrors send as their ns parameter.
+	repositories, err := source.Repositories(ctx)
+	if err != nil {
+		return err
+	}
+	namespaces := len(repositories) > 0
+	for _, repository := range repositories {
+		if !hasRegistryName(repository) {
+			namespaces = false
+			break
+		}
+	}
+
+	handler := &server.Server{Backend: source, Logger: logger, Namespaces: namespaces}
+	return listenAndServe(ctx, flags, logger, handler, "serving archive", "file", *flags.File, "namespaces", namespaces)
+}
+
+// hasRegistryName tells whether the first path segment of repository is a
+// registry host name: it holds a dot or a colon, or is localhost.
+func hasRegistryName(repository string) bool {
+	tokens := strings.SplitN(repository, "/", 2)
+	return len(tokens) == 2 && (strings.ContainsAny(tokens[0], ".:") || tokens[0] == "localhost")
+}
+
+// listenAndServe serves handler on --listen, over HTTPS with --tls-cert,
+// until ctx is cancelled. message and keyvals are logged once it listens.
+func listenAndServe(ctx context.Context, flags *common.AppFlags, logger *logging.Logger, handler http.Handler, message string, keyvals ...interface{}) error {
+	if (len(*flags.TLSCert) > 0) != (len(*flags.TLSKey) > 0) {
+		return errors.New("--tls-cert and --tls-key go together")
+	}
+	listener, err := net.Listen("tcp", *flags.Listen)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if len(*flags.TLSCert) > 0 {
+			done <- httpServer.ServeTLS(listener, *flags.TLSCert, *flags.TLSKey)
+		} else {
+			done <- httpServer.Serve(listener)
+		}
+	}()
+	scheme := "http"
+	if len(*flags.TLSCert) > 0 {
+		scheme = "https"
+	}
+	logger.Info(message, append(keyvals, "url", scheme+"://"+listener.Addr().String())...)
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	logger.Info("shutting down")
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return httpServer.Shutdown(shutdown)
+}
@@ -1,19 +1,78 @@
 package common
 
+import (
+	"strings"
+	"time"
+)
+
+// StringList is a flag.Value collecting every occurrence of a repeatable flag.
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 type AppFlags struct {
-	Url        *string
+	Url        StringList
 	Proxy      *string
 	File       *string
 	Username   *string
 	Password   *string
 	ConfigFile *string
 
+	CACert        *string
+	ClientCert    *string
+	ClientKey     *string
+	MinTLSVersion *string
+	Insecure      *bool
+
+	InsecureRegistries StringList
+
 	IsImport *bool
 	IsExport *bool
+	IsServe  *bool
+	IsRecord *bool
+
+	IsRewriteManifests *bool
+	Output             *string
+	InPlace            *bool
+	Pin                *bool
+
+	Listen  *string
+	TLSCert *string
+	TLSKey  *string
+
+	RecordFile *string
 
 	IncludeRepoName *bool
+	RouteByRegistry *bool
 
 	CacheDir *string
+	Discover StringList
+
+	RewritePrefix      *string
+	RewriteStripPrefix StringList
+	RewriteRegex       StringList
+	RewriteMap         *string
+
+	TagPolicy *string
+
+	ReportFile   *string
+	ReportFormat *string
+	BestEffort   *bool
+
+	Progress *string
+
+	LogLevel  *string
+	LogFormat *string
+
+	Timeout        *time.Duration
+	RequestTimeout *time.Duration
 
 	ImageList []string
 	Config    *Config
@@ -9,10 +9,46 @@ type RepositoryConfig struct {
 	Endpoint string `json:"endpoint"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// IdentityToken is an OAuth2 refresh token used instead of the password,
+	// such as the identitytoken "docker login" stores.
+	IdentityToken string `json:"identityToken"`
+	// PasswordGrant sends the username and password through the OAuth2
+	// password grant of the token server before its GET flow.
+	PasswordGrant bool `json:"passwordGrant"`
+
+	// CACert is a PEM bundle of CAs trusted in addition to the system ones.
+	CACert string `json:"caCert"`
+	// ClientCert and ClientKey are PEM files of a client certificate
+	// presented for mutual TLS.
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	// MinTLSVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3".
+	MinTLSVersion string `json:"minTLSVersion"`
+	// Insecure skips the verification of the registry certificate.
+	Insecure bool `json:"insecure"`
+
+	// Proxy overrides --proxy for this registry; "direct" disables proxying.
+	Proxy string `json:"proxy"`
+}
+
+// RouteConfig is the destination of a source registry when importing with
+// --route-by-registry.
+type RouteConfig struct {
+	// Registry is the key of the destination in Config.Repositories.
+	Registry string `json:"registry"`
+	// Prefix replaces the source registry segment of repository names.
+	Prefix string `json:"prefix"`
 }
 
 type Config struct {
 	Repositories map[string]*RepositoryConfig `json:"repositories"`
+	Routes       map[string]*RouteConfig      `json:"routes"`
+	// Destinations are the keys of the Repositories entries every image is
+	// imported into, in addition to --url.
+	Destinations []string `json:"destinations"`
+	// InsecureRegistries may be reached over plain HTTP and without TLS
+	// verification, in addition to --insecure-registry.
+	InsecureRegistries []string `json:"insecureRegistries"`
 }
 
 func ReadConfig(filename string) (*Config, error) {
@@ -0,0 +1,365 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress modes.
+const (
+	ProgressAuto = "auto"
+	ProgressTTY  = "tty"
+	ProgressJSON = "json"
+	ProgressNone = "none"
+)
+
+const (
+	progressBarWidth       = 30
+	progressRenderInterval = 200 * time.Millisecond
+	progressEventInterval  = time.Second
+)
+
+// Progress tracks byte transfers. On a terminal it draws a bar per active
+// transfer and one for the total, with throughput and ETA. Otherwise it
+// emits one JSON object per line for every transfer event. All methods are
+// safe to call on a nil Progress, which tracks nothing.
+type Progress struct {
+	mode string
+	out  io.Writer
+
+	mutex      sync.Mutex
+	transfers  []*Transfer
+	total      int64
+	done       int64
+	started    time.Time
+	lastRender time.Time
+	lines      int
+	closed     bool
+}
+
+// Transfer is one blob moving through a reader wrapped by Reader.
+type Transfer struct {
+	progress *Progress
+
+	ID      string
+	Name    string
+	Total   int64
+	Current int64
+
+	started   time.Time
+	lastEvent time.Time
+}
+
+// ProgressEvent is a line of the JSON progress stream.
+type ProgressEvent struct {
+	Event          string    `json:"event"`
+	Time           time.Time `json:"time"`
+	ID             string    `json:"id,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	Bytes          int64     `json:"bytes"`
+	Total          int64     `json:"total"`
+	BytesPerSecond float64   `json:"bytesPerSecond"`
+	ETASeconds     float64   `json:"etaSeconds,omitempty"`
+	OverallBytes   int64     `json:"overallBytes"`
+	OverallTotal   int64     `json:"overallTotal"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// NewProgress creates a tracker for the given mode. In auto mode bars are
+// drawn when stderr is a terminal and nothing is tracked otherwise, so that
+// stdout is left alone; JSON events are only written to stdout in
+// ProgressJSON mode. It returns nil for ProgressNone.
+func NewProgress(mode string) (*Progress, error) {
+	switch mode {
+	case "", ProgressAuto:
+		if !isTerminal(os.Stderr) {
+			return nil, nil
+		}
+		mode = ProgressTTY
+	case ProgressTTY, ProgressJSON:
+	case ProgressNone:
+		return nil, nil
+	default:
+		return nil, errors.New("invalid progress mode (expected auto, tty, json or none): " + mode)
+	}
+
+	p := &Progress{
+		mode:    mode,
+		out:     os.Stdout,
+		started: time.Now(),
+	}
+	if mode == ProgressTTY {
+		p.out = os.Stderr
+	}
+	return p, nil
+}
+
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// AddTotal adds bytes expected to be transferred to the overall total.
+func (p *Progress) AddTotal(bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total += bytes
+}
+
+// Complete counts bytes that did not need to be transferred, such as blobs
+// that already exist, as done.
+func (p *Progress) Complete(bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done += bytes
+}
+
+// Start begins a transfer of total bytes.
+func (p *Progress) Start(id string, name string, total int64) *Transfer {
+	if p == nil {
+		return nil
+	}
+	t := &Transfer{
+		progress: p,
+		ID:       id,
+		Name:     name,
+		Total:    total,
+		started:  time.Now(),
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.transfers = append(p.transfers, t)
+	p.event("start", t, nil)
+	p.render(true)
+	return t
+}
+
+// Reader returns a reader that advances the transfer as reader is consumed.
+// A seekable reader stays seekable, rewinding the transfer with it, so that
+// a retried request starts the count over.
+func (t *Transfer) Reader(reader io.Reader) io.Reader {
+	if t == nil {
+		return reader
+	}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		return &progressSeeker{progressReader{reader: reader, transfer: t}, seeker}
+	}
+	return &progressReader{reader: reader, transfer: t}
+}
+
+func (t *Transfer) Add(bytes int64) {
+	if t == nil {
+		return
+	}
+	p := t.progress
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	t.Current += bytes
+	p.done += bytes
+	if p.mode == ProgressJSON && time.Since(t.lastEvent) >= progressEventInterval {
+		t.lastEvent = time.Now()
+		p.event("progress", t, nil)
+	}
+	p.render(false)
+}
+
+// Done ends the transfer.
+func (t *Transfer) Done(err error) {
+	if t == nil {
+		return
+	}
+	p := t.progress
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, active := range p.transfers {
+		if active == t {
+			p.transfers = append(p.transfers[:i], p.transfers[i+1:]...)
+			break
+		}
+	}
+	p.event("done", t, err)
+	p.render(true)
+}
+
+// Write passes other output, such as log lines, through the tracker so that
+// it is not mixed with the bars drawn on the terminal.
+func (p *Progress) Write(data []byte) (int, error) {
+	if p == nil || p.mode != ProgressTTY {
+		return os.Stderr.Write(data)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	n, err := p.out.Write(data)
+	p.render(true)
+	return n, err
+}
+
+// Close removes the bars, or emits the final event of the JSON stream.
+func (p *Progress) Close() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.mode == ProgressTTY {
+		p.clear()
+	} else {
+		p.event("finish", nil, nil)
+	}
+	p.closed = true
+}
+
+func (p *Progress) event(name string, t *Transfer, err error) {
+	if p.mode != ProgressJSON {
+		return
+	}
+	event := &ProgressEvent{
+		Event:        name,
+		Time:         time.Now(),
+		OverallBytes: p.done,
+		OverallTotal: p.total,
+	}
+	if t != nil {
+		event.ID = t.ID
+		event.Name = t.Name
+		event.Bytes = t.Current
+		event.Total = t.Total
+		event.BytesPerSecond, event.ETASeconds = rate(t.Current, t.Total, t.started)
+	} else {
+		event.Bytes = p.done
+		event.Total = p.total
+		event.BytesPerSecond, event.ETASeconds = rate(p.done, p.total, p.started)
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	line, _ := json.Marshal(event)
+	p.out.Write(append(line, '\n'))
+}
+
+// render redraws the bars, at most every progressRenderInterval unless
+// force is set.
+func (p *Progress) render(force bool) {
+	if p.mode != ProgressTTY || p.closed {
+		return
+	}
+	if !force && time.Since(p.lastRender) < progressRenderInterval {
+		return
+	}
+	p.lastRender = time.Now()
+
+	p.clear()
+	var builder strings.Builder
+	for _, t := range p.transfers {
+		builder.WriteString(progressLine(t.Name, t.Current, t.Total, t.started))
+	}
+	builder.WriteString(progressLine("total", p.done, p.total, p.started))
+	io.WriteString(p.out, builder.String())
+	p.lines = len(p.transfers) + 1
+}
+
+// clear erases the bars drawn by the last render.
+func (p *Progress) clear() {
+	if p.lines == 0 {
+		return
+	}
+	io.WriteString(p.out, strings.Repeat("\033[1A\033[2K", p.lines)+"\r")
+	p.lines = 0
+}
+
+func progressLine(name string, current int64, total int64, started time.Time) string {
+	if len(name) > 24 {
+		name = name[:23] + "…"
+	}
+	if total > 0 && current > total {
+		total = current
+	}
+
+	filled := 0
+	percent := 0.0
+	if total > 0 {
+		percent = float64(current) * 100 / float64(total)
+		filled = int(float64(progressBarWidth) * float64(current) / float64(total))
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	bytesPerSecond, eta := rate(current, total, started)
+	line := fmt.Sprintf("%-24s [%s] %3.0f%% %s/%s %s/s", name, bar, percent, formatBytes(current), formatBytes(total), formatBytes(int64(bytesPerSecond)))
+	if eta > 0 {
+		line += " ETA " + (time.Duration(eta) * time.Second).String()
+	}
+	return line + "\n"
+}
+
+// rate returns the throughput since started and the remaining seconds.
+func rate(current int64, total int64, started time.Time) (float64, float64) {
+	elapsed := time.Since(started).Seconds()
+	if elapsed <= 0 || current <= 0 {
+		return 0, 0
+	}
+	bytesPerSecond := float64(current) / elapsed
+	eta := 0.0
+	if total > current {
+		eta = float64(total-current) / bytesPerSecond
+	}
+	return bytesPerSecond, eta
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+type progressReader struct {
+	reader   io.Reader
+	transfer *Transfer
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.transfer.Add(int64(n))
+	}
+	return n, err
+}
+
+type progressSeeker struct {
+	progressReader
+	seeker io.Seeker
+}
+
+func (r *progressSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.seeker.Seek(offset, whence)
+	if err == nil {
+		r.transfer.Add(position - r.transfer.Current)
+	}
+	return position, err
+}
@@ -0,0 +1,238 @@
+package common
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type ItemStatus string
+
+const (
+	StatusSuccess ItemStatus = "success"
+	// StatusExists means nothing was transferred because the item was
+	// already present (in the destination registry or the export cache).
+	StatusExists  ItemStatus = "exists"
+	StatusSkipped ItemStatus = "skipped"
+	StatusFailed  ItemStatus = "failed"
+)
+
+// Kinds of report items.
+const (
+	KindImage       = "image"
+	KindManifest    = "manifest"
+	KindTag         = "tag"
+	KindBlob        = "blob"
+	KindDestination = "destination"
+	KindRepository  = "repository"
+)
+
+// ReportItem is the outcome of transferring one image, manifest, tag or blob,
+// or of routing one repository.
+type ReportItem struct {
+	Kind        string     `json:"kind"`
+	Name        string     `json:"name"`
+	Repository  string     `json:"repository,omitempty"`
+	Digest      string     `json:"digest,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Status      ItemStatus `json:"status"`
+	Bytes       int64      `json:"bytes"`
+	Duration    float64    `json:"durationSeconds"`
+	Message     string     `json:"message,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	started time.Time
+}
+
+// Report collects the outcome of every item of an import or export.
+type Report struct {
+	Operation  string        `json:"operation"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Items      []*ReportItem `json:"items"`
+
+	mutex sync.Mutex
+}
+
+func NewReport(operation string) *Report {
+	return &Report{
+		Operation: operation,
+		StartedAt: time.Now(),
+		Items:     make([]*ReportItem, 0),
+	}
+}
+
+// Track adds an item to the report and starts timing it. The item is
+// completed with Done. A nil report returns an item that is not recorded.
+func (r *Report) Track(kind string, name string) *ReportItem {
+	item := &ReportItem{
+		Kind:    kind,
+		Name:    name,
+		started: time.Now(),
+	}
+	if r != nil {
+		r.mutex.Lock()
+		r.Items = append(r.Items, item)
+		r.mutex.Unlock()
+	}
+	return item
+}
+
+// Note appends message to the message of the item.
+func (item *ReportItem) Note(message string) {
+	if len(item.Message) > 0 {
+		item.Message += ", "
+	}
+	item.Message += message
+}
+
+func (item *ReportItem) Done(status ItemStatus, bytes int64, err error) {
+	item.Status = status
+	item.Bytes = bytes
+	item.Duration = time.Since(item.started).Seconds()
+	if err != nil {
+		item.Error = err.Error()
+	}
+}
+
+// Failed returns the number of failed items.
+func (r *Report) Failed() int {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	failed := 0
+	for _, item := range r.Items {
+		if item.Status == StatusFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteFile writes the report to filename in the given format, "json" or
+// "junit".
+func (r *Report) WriteFile(filename string, format string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case "", "json":
+		err = r.WriteJSON(file)
+	case "junit":
+		err = r.WriteJUnit(file)
+	default:
+		err = errors.New("invalid report format (expected json or junit): " + format)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (r *Report) WriteJSON(writer io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.FinishedAt = time.Now()
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Name    string            `xml:"name,attr"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+// WriteJUnit writes the report as JUnit XML with one test suite per item
+// kind and one test case per item.
+func (r *Report) WriteJUnit(writer io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.FinishedAt = time.Now()
+
+	output := &junitTestSuites{Name: r.Operation}
+	suites := make(map[string]*junitTestSuite)
+	durations := make(map[string]float64)
+	for _, item := range r.Items {
+		suite := suites[item.Kind]
+		if suite == nil {
+			suite = &junitTestSuite{Name: r.Operation + "." + item.Kind}
+			suites[item.Kind] = suite
+			output.Suites = append(output.Suites, suite)
+		}
+
+		className := item.Kind
+		if len(item.Destination) > 0 {
+			className = item.Destination
+		}
+		testCase := &junitTestCase{
+			ClassName: className,
+			Name:      item.Name,
+			Time:      fmt.Sprintf("%.3f", item.Duration),
+			SystemOut: item.Message,
+		}
+		switch item.Status {
+		case StatusFailed:
+			testCase.Failure = &junitFailure{Message: item.Error, Text: item.Error}
+			suite.Failures++
+		case StatusSkipped:
+			testCase.Skipped = &junitSkipped{Message: item.Message}
+			suite.Skipped++
+		}
+		suite.Tests++
+		durations[item.Kind] += item.Duration
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	for kind, suite := range suites {
+		suite.Time = fmt.Sprintf("%.3f", durations[kind])
+	}
+
+	if _, err := io.WriteString(writer, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, "\n")
+	return err
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule replaces every match of Pattern in a repository name with
+// Replacement. Replacement may refer to capture groups as in
+// regexp.Regexp.ReplaceAllString.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Rewriter maps a repository name found in an archive to the name it is
+// pushed as. An exact Mapping entry wins over everything else; otherwise
+// StripPrefix, Rules and Prefix are applied in that order.
+type Rewriter struct {
+	Mapping     map[string]string
+	StripPrefix []string
+	Rules       []*RewriteRule
+	Prefix      string
+}
+
+// ParseRewriteRule parses a rule in the form "pattern=replacement". It is
+// split at the last "=", which a repository name, and so the replacement,
+// cannot hold, so that the pattern may hold some, as in [^=]+.
+func ParseRewriteRule(rule string) (*RewriteRule, error) {
+	index := strings.LastIndex(rule, "=")
+	if index <= 0 {
+		return nil, errors.New("invalid rewrite rule (expected pattern=replacement): " + rule)
+	}
+	pattern, err := regexp.Compile(rule[:index])
+	if err != nil {
+		return nil, err
+	}
+	return &RewriteRule{
+		Pattern:     pattern,
+		Replacement: rule[index+1:],
+	}, nil
+}
+
+// ReadRewriteMapping reads a JSON object of source to destination
+// repository names.
+func ReadRewriteMapping(filename string) (map[string]string, error) {
+	input, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string)
+	if err = json.Unmarshal(input, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+func (r *Rewriter) Rewrite(repository string) string {
+	if r == nil {
+		return repository
+	}
+	if mapped, ok := r.Mapping[repository]; ok {
+		return mapped
+	}
+	for _, prefix := range r.StripPrefix {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		if strings.HasPrefix(repository, prefix) {
+			repository = strings.TrimPrefix(repository, prefix)
+			break
+		}
+	}
+	for _, rule := range r.Rules {
+		repository = rule.Pattern.ReplaceAllString(repository, rule.Replacement)
+	}
+	if len(r.Prefix) > 0 {
+		repository = strings.TrimSuffix(r.Prefix, "/") + "/" + repository
+	}
+	return repository
+}
@@ -0,0 +1,75 @@
+package common
+
+import "testing"
+
+func TestParseRewriteRule(t *testing.T) {
+	tests := []struct {
+		rule        string
+		pattern     string
+		replacement string
+		invalid     bool
+	}{
+		{rule: "^library/=mirror/", pattern: "^library/", replacement: "mirror/"},
+		{rule: "^(.*)$=mirror/$1", pattern: "^(.*)$", replacement: "mirror/$1"},
+		{rule: "[^=]+/(.*)=$1", pattern: "[^=]+/(.*)", replacement: "$1"},
+		{rule: "^old=", pattern: "^old", replacement: ""},
+		{rule: "no-separator", invalid: true},
+		{rule: "=replacement", invalid: true},
+		{rule: "(=x", invalid: true},
+	}
+	for _, test := range tests {
+		rule, err := ParseRewriteRule(test.rule)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: parsed as %q=%q", test.rule, rule.Pattern, rule.Replacement)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.rule, err)
+			continue
+		}
+		if rule.Pattern.String() != test.pattern || rule.Replacement != test.replacement {
+			t.Errorf("%q: got %q=%q, want %q=%q", test.rule, rule.Pattern, rule.Replacement, test.pattern, test.replacement)
+		}
+	}
+}
+
+func TestRewriterRewrite(t *testing.T) {
+	rule := func(rule string) *RewriteRule {
+		parsed, err := ParseRewriteRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	rewriter := &Rewriter{
+		Mapping:     map[string]string{"docker.io/library/nginx": "web/nginx"},
+		StripPrefix: []string{"docker.io", "quay.io/"},
+		Rules:       []*RewriteRule{rule("^library/=base/"), rule("^base/(.*)$=$1-image")},
+		Prefix:      "mirror/",
+	}
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		// An exact mapping wins over every other rule.
+		{"docker.io/library/nginx", "web/nginx"},
+		// The prefix is stripped first, then the rules apply in turn, then
+		// the prefix is added.
+		{"docker.io/library/alpine", "mirror/alpine-image"},
+		{"quay.io/library/alpine", "mirror/alpine-image"},
+		{"library/alpine", "mirror/alpine-image"},
+		{"ghcr.io/app", "mirror/ghcr.io/app"},
+		// The stripped prefix must end at a path segment.
+		{"docker.iox/app", "mirror/docker.iox/app"},
+	}
+	for _, test := range tests {
+		if got := rewriter.Rewrite(test.repository); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.repository, got, test.want)
+		}
+	}
+	if got := (*Rewriter)(nil).Rewrite("library/alpine"); got != "library/alpine" {
+		t.Errorf("nil rewriter: got %s", got)
+	}
+}
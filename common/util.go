@@ -1,6 +1,9 @@
 package common
 
-import "io"
+import (
+	"io"
+	"strings"
+)
 
 func IoConsumeAll(reader io.Reader) (int64, error) {
 	buf := make([]byte, 1024)
@@ -20,3 +23,15 @@ func IoConsumeAll(reader io.Reader) (int64, error) {
 	}
 	return totalBytes, nil
 }
+
+// ShortDigest returns the first 12 characters of the encoded part of a digest,
+// as docker shows image IDs.
+func ShortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		digest = digest[i+1:]
+	}
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return digest
+}
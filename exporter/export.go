@@ -1,297 +1,174 @@
 package exporter
 
 import (
-	"archive/tar"
-	"crypto"
-	"encoding/hex"
-	"github.com/docker/distribution"
-	"github.com/docker/distribution/manifest/manifestlist"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jc-lab/docker-registry-importer/common"
-	"github.com/jc-lab/docker-registry-importer/internal/registry"
-	"github.com/opencontainers/go-digest"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/record"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
 	"io"
-	"log"
-	"net/http"
-	"os"
 	"strings"
-	"time"
 )
 
-type ImageContext struct {
-	reg           *registry.Registry
-	leafManifests []distribution.Manifest
-}
-
 type ExportContext struct {
-	registry map[string]*registry.Registry
+	// Report, Progress and Observer are those of Options.
+	Report   *common.Report
+	Progress *common.Progress
+	Observer event.Observer
+	// Registries are the clients of source registries by host name.
+	Registries map[string]*registry.Registry
+	// NewRegistry builds the client of a source registry that is not in
+	// Registries from its host name. When it is nil, GetRegistry builds one
+	// from Config.
+	NewRegistry func(c context.Context, registryName string) (*registry.Registry, error)
+	// Config holds the endpoints and credentials of source registries; it
+	// may be nil.
+	Config *common.Config
+
+	// IncludeRepoName prefixes the archive paths with the source registry.
+	IncludeRepoName bool
+	// CacheDir keeps downloaded blobs across exports when it is not empty.
+	CacheDir string
+	// Recording pins the tags it holds to the manifests recorded; its
+	// images are exported when none is given.
+	Recording *record.Recording
+	// Destination, when set, receives the images instead of the archive
+	// given to DoExport, and is left open.
+	Destination copier.Destination
 
-	images   []*ImageContext
-	blobs    map[string]*ExportBlobItem
-	tempDir  string
-	cacheDir string
-}
-
-type ExportBlobItem struct {
-	downloaded    bool
-	size          int64
-	cachedContent []byte
+	registry map[string]*registry.Registry
 }
 
-func (ctx *ExportContext) DoExport(flags *common.AppFlags) {
+// DoExport writes every image, given as registry/repository:tag or
+// registry/repository@digest, into the archive. The outcome of every image
+// and blob is recorded in ctx.Report; the returned error is reserved for an
+// archive that cannot be written.
+//
+// When c is cancelled, the images not exported yet are reported as failed
+// and the archive is closed with the entries written so far.
+func (ctx *ExportContext) DoExport(c context.Context, archive io.Writer, images []string) error {
 	ctx.registry = make(map[string]*registry.Registry)
-	ctx.blobs = make(map[string]*ExportBlobItem)
-
-	fileWriter, err := os.OpenFile(*flags.File, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		log.Fatalln(err)
-		return
+	for name, reg := range ctx.Registries {
+		ctx.registry[name] = reg
 	}
-	tarWriter := tar.NewWriter(fileWriter)
-	defer tarWriter.Close()
-	defer fileWriter.Close()
-
-	ctx.tempDir = os.TempDir()
-	ctx.cacheDir = *flags.CacheDir
-
-	if len(ctx.cacheDir) > 0 {
-		_ = os.MkdirAll(ctx.cacheDir+"/blob/", 0755)
+	if ctx.Report == nil {
+		ctx.Report = common.NewReport("export")
 	}
 
-	for _, imageName := range flags.ImageList {
-		tokens := strings.SplitN(imageName, "/", 2)
-		registryName := tokens[0]
-		tokens = strings.SplitN(tokens[1], ":", 2)
-		imageName := tokens[0]
-		imageVersion := tokens[1]
-
-		repo, err := ctx.GetRegistry(registryName, flags.Config)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		manifest, err := repo.ManifestV2(imageName, imageVersion)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		directoryName := ""
-		if *flags.IncludeRepoName {
-			directoryName = registryName + "/"
+	var source copier.Source = &copier.RegistriesSource{
+		Registry: func(c context.Context, name string) (*registry.Registry, error) {
+			return ctx.GetRegistry(c, name, ctx.Config)
+		},
+	}
+	if len(ctx.CacheDir) > 0 {
+		source = &copier.CachedSource{Source: source, Dir: ctx.CacheDir, Observer: ctx.Observer}
+	}
+	if ctx.Recording != nil {
+		source = &record.Source{Source: source, Recording: ctx.Recording}
+		if len(images) == 0 {
+			images = ctx.Recording.ImageNames()
 		}
-		directoryName += imageName
-		directoryName += "/manifests"
-
-		_, payload, _ := manifest.Payload()
-
-		hash := crypto.SHA256.New()
-		hash.Write(payload)
-		d := hash.Sum(nil)
-
-		digestName := "sha256:" + hex.EncodeToString(d)
+	}
+	destination := ctx.Destination
+	var archiveDestination *copier.ArchiveDestination
+	if destination == nil {
+		archiveDestination = copier.NewArchiveDestination(archive)
+		destination = archiveDestination
+	}
 
-		// storeManifest
-		for _, name := range []string{
-			directoryName + "/" + imageVersion,
-			directoryName + "/" + digestName,
-		} {
-			writeToTar(tarWriter, name, payload)
+	for _, imageName := range images {
+		item := ctx.Report.Track(common.KindImage, imageName)
+		err := c.Err()
+		if err == nil {
+			ctx.emit(&event.Event{Type: event.ImageStarted, Repository: imageName})
+			err = ctx.exportImage(c, source, destination, imageName, item)
 		}
-
-		imageCtx := ImageContext{}
-		imageCtx.addManifest(repo, imageName, manifest, tarWriter, directoryName)
-
-		for _, manifest := range imageCtx.leafManifests {
-			for _, reference := range manifest.References() {
-				ctx.downloadBlob(repo, imageName, tarWriter, reference.Digest, false)
-			}
+		if err != nil {
+			ctx.emit(&event.Event{Type: event.ImageFailed, Repository: imageName, Digest: item.Digest, Bytes: item.Bytes, Err: err})
+			item.Done(common.StatusFailed, item.Bytes, err)
+		} else {
+			ctx.emit(&event.Event{Type: event.ImageDone, Repository: imageName, Digest: item.Digest, Bytes: item.Bytes})
+			item.Done(common.StatusSuccess, item.Bytes, nil)
 		}
 	}
 
-	tarWriter.Flush()
+	if archiveDestination == nil {
+		return nil
+	}
+	return archiveDestination.Close()
 }
 
-func (ctx *ImageContext) addManifest(reg *registry.Registry, imageName string, manifest distribution.Manifest, tarWriter *tar.Writer, tarDirectoryName string) {
-	switch typed := manifest.(type) {
-	case *manifestlist.DeserializedManifestList:
-		for _, descriptor := range typed.ManifestList.Manifests {
-			manifest, err := reg.ManifestV2(imageName, descriptor.Digest.String())
-			if err != nil {
-				log.Fatalln(err)
-			}
-			_, payload, err := manifest.Payload()
-			if err != nil {
-				log.Fatalln(err)
-			}
-			writeToTar(tarWriter, tarDirectoryName+"/"+descriptor.Digest.String(), payload)
-			ctx.addManifest(reg, imageName, manifest, tarWriter, tarDirectoryName)
-		}
-	default:
-		ctx.leafManifests = append(ctx.leafManifests, manifest)
-	}
+func (ctx *ExportContext) emit(e *event.Event) {
+	event.Emit(ctx.Observer, e)
 }
 
-func writeToTar(tarWriter *tar.Writer, name string, data []byte) {
-	err := tarWriter.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     name,
-		Size:     int64(len(data)),
-		Mode:     0644,
-		ModTime:  time.Now(),
+func (ctx *ExportContext) exportImage(c context.Context, source copier.Source, destination copier.Destination, imageName string, item *common.ReportItem) error {
+	tokens := strings.SplitN(imageName, "/", 2)
+	if len(tokens) != 2 {
+		return errors.New("invalid image name (expected registry/repository:tag)")
+	}
+	registryName := tokens[0]
+	if !strings.ContainsAny(tokens[1], ":@") {
+		return errors.New("invalid image name (expected registry/repository:tag)")
+	}
+	image := copier.ParseImage(tokens[1])
+	item.Repository = image.Repository
+	image.Repository = registryName + "/" + image.Repository
+
+	result, err := copier.Copy(c, source, destination, &copier.Options{
+		Images:   []copier.Image{image},
+		Rename:   ctx.archiveRepository,
+		Report:   ctx.Report,
+		Progress: ctx.Progress,
+		Observer: ctx.Observer,
 	})
+	if result == nil {
+		return err
+	}
+	item.Digest = result.Images[0].Digest.String()
+	item.Bytes = result.BytesCopied
 	if err != nil {
-		log.Fatalln(err)
-		return
+		return err
 	}
-	tarWriter.Write(data)
-}
-
-func (ctx *ExportContext) downloadBlob(reg *registry.Registry, repository string, tarWriter *tar.Writer, d digest.Digest, read bool) ([]byte, error) {
-	blob := ctx.blobs[d.String()]
-	if blob != nil && (!read || (blob.cachedContent != nil && read)) {
-		return blob.cachedContent, nil
+	if err := result.Images[0].Err; err != nil {
+		return err
 	}
-	blob = &ExportBlobItem{}
-	ctx.blobs[d.String()] = blob
-
-	cacheDirUsable := len(ctx.cacheDir) > 0
-
-	blobFileName := ctx.tempDir + "/" + d.String()
-
-	fileToTar := func(filename string, size int64) {
-		err := tarWriter.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     "blob/" + d.String(),
-			Size:     size,
-			Mode:     0644,
-			ModTime:  time.Now(),
-		})
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		file, err := os.Open(blobFileName)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer file.Close()
-
-		_, err = io.Copy(tarWriter, file)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		blob.downloaded = true
+	if result.BlobsFailed > 0 {
+		return fmt.Errorf("%d blobs failed", result.BlobsFailed)
 	}
+	return nil
+}
 
-	if cacheDirUsable {
-		blobFileName = ctx.cacheDir + "/blob/" + d.String()
-		stat, err := os.Stat(blobFileName)
-		if err == nil {
-			if checkHash(blobFileName, d) {
-				fileToTar(blobFileName, stat.Size())
-				if read {
-					return os.ReadFile(blobFileName)
-				}
-				return nil, nil
-			} else {
-				log.Println("cached " + d.String() + " invalid")
-			}
-		}
+// archiveRepository returns the archive path of a registry/repository name,
+// which keeps the registry with IncludeRepoName.
+func (ctx *ExportContext) archiveRepository(repository string) (string, bool) {
+	if ctx.IncludeRepoName {
+		return repository, true
 	}
+	return strings.SplitN(repository, "/", 2)[1], true
+}
 
-	var fileSize int64 = 0
-
-	func() {
-		reader, err := reg.DownloadBlob(repository, d)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer reader.Close()
-
-		file, err := os.OpenFile(blobFileName, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer file.Close()
-
-		fileSize, err = file.ReadFrom(reader)
+func (ctx *ExportContext) GetRegistry(c context.Context, registryName string, config *common.Config) (*registry.Registry, error) {
+	reg := ctx.registry[registryName]
+	if reg == nil && ctx.NewRegistry != nil {
+		var err error
+		reg, err = ctx.NewRegistry(c, registryName)
 		if err != nil {
-			log.Println(err)
-			return
+			return nil, err
 		}
-	}()
-
-	fileToTar(blobFileName, fileSize)
-
-	if !cacheDirUsable {
-		defer os.Remove(blobFileName)
-	}
-
-	if read {
-		return os.ReadFile(blobFileName)
+		ctx.registry[registryName] = reg
 	}
-	return nil, nil
-}
-
-func (ctx *ExportContext) GetRegistry(registryName string, config *common.Config) (*registry.Registry, error) {
-	reg := ctx.registry[registryName]
 	if reg == nil {
-		url := "https://" + registryName
-		username := ""
-		password := ""
-
-		if registryName == "docker.io" {
-			url = "https://registry-1.docker.io"
-		}
-
-		transport := &http.Transport{
-			DisableKeepAlives: true,
-		}
-
-		if config != nil {
-			repoConfig := config.Repositories[registryName]
-			if repoConfig != nil {
-				if len(repoConfig.Username) > 0 || len(repoConfig.Password) > 0 {
-					username = repoConfig.Username
-					password = repoConfig.Password
-				}
-				if len(repoConfig.Endpoint) > 0 {
-					url = strings.TrimSuffix(repoConfig.Endpoint, "/")
-				}
-			}
-		}
-		wrappedTransport := registry.WrapTransport(transport, url, username, password)
-		reg = &registry.Registry{
-			URL: url,
-			Client: &http.Client{
-				Transport: wrappedTransport,
-			},
-			Logf: registry.Log,
+		var err error
+		reg, err = registry.NewFromConfig(c, registryName, config, &registry.ClientOptions{Observer: ctx.Observer})
+		if err != nil {
+			return nil, err
 		}
 		ctx.registry[registryName] = reg
 	}
 
 	return reg, nil
 }
-
-func checkHash(filename string, d digest.Digest) bool {
-	file, err := os.Open(filename)
-	if err != nil {
-		return false
-	}
-	defer file.Close()
-
-	hash := d.Algorithm().Digester().Hash()
-	_, err = io.Copy(hash, file)
-	if err != nil {
-		return false
-	}
-	return d.Hex() == hex.EncodeToString(hash.Sum(nil))
-}
@@ -0,0 +1,92 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/record"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+)
+
+// Options configure Export.
+type Options struct {
+	// Archive receives the tar archive. It is not closed.
+	Archive io.Writer
+	// Destination receives the images instead of Archive when it is set,
+	// such as a copier.OCILayoutDestination or a
+	// copier.DockerArchiveDestination. It is not closed either.
+	Destination copier.Destination
+	// Images to export, as registry/repository:tag or
+	// registry/repository@digest.
+	Images []string
+
+	// Registries are the clients of source registries by host name, such
+	// as "docker.io" or "registry.example.com:5000".
+	Registries map[string]*registry.Registry
+	// NewRegistry builds the clients of the registries not in Registries.
+	// When it is nil, they are built from Config.
+	NewRegistry func(c context.Context, registryName string) (*registry.Registry, error)
+	// Config holds the endpoints and credentials of source registries; it
+	// may be nil.
+	Config *common.Config
+
+	// IncludeRepoName prefixes the archive paths with the source registry.
+	IncludeRepoName bool
+	// CacheDir keeps downloaded blobs across exports when it is not empty.
+	CacheDir string
+	// Recording, written by a record.Proxy, pins the tags it holds to the
+	// manifests clients pulled. When Images is empty, the images of the
+	// recording are exported.
+	Recording *record.Recording
+
+	// Report, Progress and Observer are those of the copy into the archive,
+	// as copier.Options documents them.
+	Report   *common.Report
+	Progress *common.Progress
+	Observer event.Observer
+}
+
+// Result is the outcome of Export.
+type Result struct {
+	// Report holds the outcome of every image and blob.
+	Report *common.Report
+}
+
+// Failed returns the number of failed items.
+func (r *Result) Failed() int {
+	return r.Report.Failed()
+}
+
+/*
+ * Export the images of opts into opts.Archive. Images that fail do not stop
+ * the export and are reported in the result; the returned error is reserved
+ * for invalid options, an archive that cannot be written and the
+ * cancellation of c, in which case the result is still returned along with
+ * an archive holding the images exported so far.
+ */
+func Export(c context.Context, opts *Options) (*Result, error) {
+	if opts.Archive == nil && opts.Destination == nil {
+		return nil, errors.New("no archive to export to")
+	}
+
+	ctx := &ExportContext{
+		Report:          opts.Report,
+		Progress:        opts.Progress,
+		Observer:        opts.Observer,
+		Registries:      opts.Registries,
+		NewRegistry:     opts.NewRegistry,
+		Config:          opts.Config,
+		IncludeRepoName: opts.IncludeRepoName,
+		CacheDir:        opts.CacheDir,
+		Recording:       opts.Recording,
+		Destination:     opts.Destination,
+	}
+	if err := ctx.DoExport(c, opts.Archive, opts.Images); err != nil {
+		return nil, err
+	}
+	return &Result{Report: ctx.Report}, c.Err()
+}
@@ -8,6 +8,7 @@ require (
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.2
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,43 @@
+package importer
+
+import (
+	"strings"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+)
+
+// Destination is a registry the archive is imported into.
+type Destination struct {
+	Name     string
+	Registry *registry.Registry
+
+	// Routes maps the first path segment of archive repositories (the source
+	// registry of archives exported with --include-repo-name) to the prefix
+	// that replaces it on this destination. An empty prefix strips the
+	// segment. A destination without routes accepts every repository as is.
+	Routes map[string]string
+
+	result copier.Result
+	err    error
+}
+
+// repository returns the repository an archive repository is pushed to on
+// this destination, or false if the destination does not accept it.
+func (d *Destination) repository(repository string) (string, bool) {
+	if d.Routes == nil {
+		return repository, true
+	}
+	tokens := strings.SplitN(repository, "/", 2)
+	if len(tokens) != 2 {
+		return "", false
+	}
+	prefix, ok := d.Routes[tokens[0]]
+	if !ok {
+		return "", false
+	}
+	if len(prefix) > 0 {
+		return strings.TrimSuffix(prefix, "/") + "/" + tokens[1], true
+	}
+	return tokens[1], true
+}
@@ -1,332 +1,168 @@
 package importer
 
 import (
-	"archive/tar"
-	"encoding/json"
-	"github.com/docker/distribution"
-	"github.com/docker/distribution/manifest"
-	"github.com/docker/distribution/manifest/manifestlist"
-	"github.com/docker/distribution/manifest/ocischema"
-	"github.com/docker/distribution/manifest/schema2"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jc-lab/docker-registry-importer/common"
-	"github.com/jc-lab/docker-registry-importer/internal/registry"
-	"github.com/jc-lab/docker-registry-importer/pkg/schema1ex"
-	"github.com/opencontainers/go-digest"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
 	"io"
-	"log"
-	"os"
-	"regexp"
-	"sort"
 )
 
-type ManifestFile struct {
-	repository  string
-	name        string
-	digestType  string
-	digestValue string
-	tag         string
-	data        []byte
-
-	manifest   distribution.Manifest
-	descriptor distribution.Descriptor
-	sortWeight int
-}
-
-type BlobItem struct {
-	uploaded  bool
-	manifests []*ManifestFile
-	size      int64
-}
-
 type ImportContext struct {
-	Registry  *registry.Registry
-	manifests []*ManifestFile
-	blobs     map[string]*BlobItem
+	Registry *registry.Registry
+	Rewriter *common.Rewriter
+	// TagPolicy, Report, Progress and Observer are those of Options.
+	TagPolicy TagPolicy
+	Report    *common.Report
+	Progress  *common.Progress
+	Observer  event.Observer
+
+	// Source, when set, is imported instead of the archive given to
+	// DoImport: any copier.Source, such as an OCI image layout or a
+	// docker-archive.
+	Source copier.Source
+
+	// Destinations the archive is imported into. When empty, DoImport sets
+	// it to Registry alone, so that the outcome of every destination can be
+	// read from it afterwards.
+	Destinations []*Destination
+
+	source copier.Source
+	images []copier.Image
 }
 
-var regexpManifestFile, _ = regexp.Compile("^(.+)/manifests/([^/:]+):(.+)$")
-var regexpTagManifestFile, _ = regexp.Compile("^(.+)/manifests/([^/:]+)$")
-var regexpTagFile, _ = regexp.Compile("^(.+)/tags/(.+)$")
-var regxpBlobFile, _ = regexp.Compile("^blob/([^/:]+):(.+)$")
-
-func (ctx *ImportContext) DoImport(flags *common.AppFlags) {
-	err := ctx.parseArchive(*flags.File)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	err = ctx.uploadBlobs(*flags.File)
-	if err != nil {
-		log.Fatalln(err)
+// DoImport parses the archive once and imports it into every destination.
+// A failing destination does not stop the others. The outcome of every
+// destination, blob, manifest and tag is recorded in ctx.Report; the
+// returned error is reserved for an archive that cannot be read.
+//
+// The archive is read several times; unless it is an io.ReaderAt and an
+// io.Seeker, such as an *os.File, it is first copied to a temporary file.
+//
+// When c is cancelled, the import stops after cancelling the uploads in
+// flight; the destinations not finished are reported as failed.
+func (ctx *ImportContext) DoImport(c context.Context, archive io.Reader) error {
+	if ctx.Report == nil {
+		ctx.Report = common.NewReport("import")
 	}
 
-	err = ctx.uploadManifests()
-	if err != nil {
-		log.Fatalln(err)
-	}
-}
-
-func (ctx *ImportContext) parseArchive(file string) error {
-	ctx.manifests = make([]*ManifestFile, 0)
-	ctx.blobs = make(map[string]*BlobItem)
-
-	reader, err := os.OpenFile(file, os.O_RDONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	tarReader := tar.NewReader(reader)
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF || header == nil {
-			break
-		} else if err != nil {
+	ctx.source = ctx.Source
+	if ctx.source == nil {
+		source, err := copier.OpenArchiveSource(archive)
+		if err != nil {
 			return err
 		}
-
-		groups := regexpTagManifestFile.FindStringSubmatch(header.Name)
-		if groups != nil {
-			repo := groups[1]
-			tag := groups[2]
-
-			log.Printf("MANIFEST: " + repo + ":" + tag)
-
-			data, err := io.ReadAll(tarReader)
-			if err != nil {
-				return err
-			}
-
-			item := &ManifestFile{
-				repository: repo,
-				name:       tag,
-				tag:        tag,
-				data:       data,
-			}
-			err = ctx.readManifest(item)
-			if err != nil {
-				return err
-			}
-			ctx.manifests = append(ctx.manifests, item)
-		}
-
-		groups = regexpManifestFile.FindStringSubmatch(header.Name)
-		if groups != nil {
-			repo := groups[1]
-			digestType := groups[2]
-			digestValue := groups[3]
-
-			log.Printf("MANIFEST: " + repo + "@" + digestType + ":" + digestValue)
-
-			data, err := io.ReadAll(tarReader)
-			if err != nil {
-				return err
-			}
-
-			item := &ManifestFile{
-				repository:  repo,
-				name:        digestType + ":" + digestValue,
-				digestType:  digestType,
-				digestValue: digestValue,
-				data:        data,
-			}
-			err = ctx.readManifest(item)
-			if err != nil {
-				return err
-			}
-			ctx.manifests = append(ctx.manifests, item)
-		}
-
-		//groups = regexpTagFile.FindStringSubmatch(header.Name)
-		//if groups != nil {
-		//	name := groups[1]
-		//	tag := groups[2]
-		//
-		//	log.Printf("MANIFEST: " + name + ":" + tag)
-		//
-		//	data, err := io.ReadAll(tarReader)
-		//	if err != nil {
-		//		return err
-		//	}
-		//
-		//	item := &ManifestFile{
-		//		repository: name,
-		//		tag:        tag,
-		//		data:       data,
-		//	}
-		//
-		//	err = ctx.readManifest(item)
-		//	if err != nil {
-		//		return err
-		//	}
-		//	ctx.manifests = append(ctx.manifests, item)
-		//}
-
-		groups = regxpBlobFile.FindStringSubmatch(header.Name)
-		if groups != nil {
-			digestType := groups[1]
-			digestValue := groups[2]
-			digestFull := digestType + ":" + digestValue
-			blob := ctx.blobs[digestFull]
-			if blob == nil {
-				blob = &BlobItem{
-					manifests: make([]*ManifestFile, 0),
-				}
-				ctx.blobs[digestFull] = blob
-			}
-			blob.size, err = common.IoConsumeAll(tarReader)
-			if err != nil {
-				return err
-			}
-		}
+		defer source.Close()
+		ctx.source = source
 	}
 
-	return nil
-}
-
-func (ctx *ImportContext) readManifest(item *ManifestFile) error {
 	var err error
-	var manifestVersion manifest.Versioned
-	if err = json.Unmarshal(item.data, &manifestVersion); err != nil {
-		return err
-	}
-
-	item.manifest, item.descriptor, err = distribution.UnmarshalManifest(manifestVersion.MediaType, item.data)
+	ctx.images, err = ctx.source.Images(c)
 	if err != nil {
 		return err
 	}
 
-	switch m := item.manifest.(type) {
-	case *schema1ex.DeserializedManifest:
-		for _, v := range m.FSLayers {
-			blob := ctx.blobs[v.BlobSum.String()]
-			if blob == nil {
-				blob = &BlobItem{
-					manifests: make([]*ManifestFile, 0),
-				}
-				ctx.blobs[v.BlobSum.String()] = blob
-			}
-			blob.manifests = append(blob.manifests, item)
-		}
-
-		//packedManifest = fromSchemaV1(item.data, item.manifestV1)
-
-	case *schema2.DeserializedManifest:
-		for _, v := range append(m.Layers, m.Config) {
-			blob := ctx.blobs[v.Digest.String()]
-			if blob == nil {
-				blob = &BlobItem{
-					manifests: make([]*ManifestFile, 0),
-				}
-				ctx.blobs[v.Digest.String()] = blob
-			}
-			blob.manifests = append(blob.manifests, item)
-		}
-
-	case *manifestlist.DeserializedManifestList:
-		item.sortWeight = -1
-
-	case *ocischema.DeserializedManifest:
-		for _, v := range append(m.Layers, m.Config) {
-			blob := ctx.blobs[v.Digest.String()]
-			if blob == nil {
-				blob = &BlobItem{
-					manifests: make([]*ManifestFile, 0),
-				}
-				ctx.blobs[v.Digest.String()] = blob
-			}
-			blob.manifests = append(blob.manifests, item)
+	if len(ctx.Destinations) == 0 {
+		ctx.Destinations = []*Destination{{
+			Name:     ctx.Registry.URL,
+			Registry: ctx.Registry,
+		}}
+	}
+	destinations := ctx.Destinations
+	ctx.checkRoutes(destinations)
+
+	for _, dest := range destinations {
+		ctx.emit(&event.Event{Type: event.DestinationStarted, Destination: dest.Name})
+		item := ctx.Report.Track(common.KindDestination, dest.Name)
+		item.Destination = dest.Name
+		dest.err = ctx.importTo(c, dest)
+		if dest.err != nil {
+			ctx.emit(&event.Event{Type: event.DestinationFailed, Destination: dest.Name, Bytes: dest.result.BytesCopied, Err: dest.err})
+			item.Done(common.StatusFailed, dest.result.BytesCopied, dest.err)
+		} else {
+			ctx.emit(&event.Event{Type: event.DestinationDone, Destination: dest.Name, Bytes: dest.result.BytesCopied})
+			item.Done(common.StatusSuccess, dest.result.BytesCopied, nil)
 		}
-
-	default:
-		log.Printf("UNKNOWN MANIFEST: %s", item.descriptor.MediaType)
 	}
 
+	for _, dest := range destinations {
+		ctx.emit(&event.Event{
+			Type:        event.Notice,
+			Destination: dest.Name,
+			Message: fmt.Sprintf("SUMMARY %s: blobs uploaded=%d existing=%d failed=%d, manifests pushed=%d failed=%d, tag conflicts=%d",
+				dest.Name,
+				dest.result.BlobsCopied, dest.result.BlobsExisting, dest.result.BlobsFailed,
+				dest.result.ManifestsPushed, dest.result.ManifestsFailed, dest.result.TagConflicts),
+		})
+	}
 	return nil
 }
 
-func (ctx *ImportContext) uploadBlobs(file string) error {
-	reader, err := os.OpenFile(file, os.O_RDONLY, 0)
-	if err != nil {
+func (ctx *ImportContext) emit(e *event.Event) {
+	event.Emit(ctx.Observer, e)
+}
+
+// importTo copies the images of the archive into dest; the copy engine
+// takes care of the blobs dest already has, of mounts and of the order of
+// manifests.
+func (ctx *ImportContext) importTo(c context.Context, dest *Destination) error {
+	if err := c.Err(); err != nil {
 		return err
 	}
-	defer reader.Close()
-
-	tarReader := tar.NewReader(reader)
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF || header == nil {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		groups := regxpBlobFile.FindStringSubmatch(header.Name)
-		if groups != nil {
-			digestType := groups[1]
-			digestValue := groups[2]
-			digestFull := digestType + ":" + digestValue
-			blob := ctx.blobs[digestFull]
-			if blob == nil {
-				log.Printf("empty blob: " + digestValue)
-				continue
-			}
-			if len(blob.manifests) == 0 {
-				log.Printf("NO MANIFEST FOR BLOB: %s", digestFull)
-				continue
-			}
-			manifest := blob.manifests[0]
-
-			log.Printf("UPLOAD BLOB: " + digestValue + " (" + manifest.repository + ") START")
-
-			d := digest.NewDigestFromHex(digestType, digestValue)
-
-			has, _ := ctx.Registry.HasBlob(manifest.repository, d)
-			if has {
-				log.Printf("UPLOAD BLOB: " + d.String() + " (" + manifest.repository + ") ALREADY EXISTS")
-			} else {
-				err := ctx.Registry.UploadBlob(manifest.repository, d, tarReader, blob.size)
-				if err == nil {
-					log.Printf("UPLOAD BLOB: " + d.String() + " (" + manifest.repository + ") SUCCESS")
-				} else {
-					log.Printf("UPLOAD BLOB: " + d.String() + " (" + manifest.repository + ") FAILED: " + err.Error())
-				}
-			}
-		}
+	if err := dest.Registry.Ping(c); err != nil {
+		return fmt.Errorf("ping failed: %v", err)
 	}
-
-	return nil
+	result, err := copier.Copy(c, ctx.source, &copier.RegistryDestination{Registry: dest.Registry}, &copier.Options{
+		Images: ctx.images,
+		Rename: func(repository string) (string, bool) {
+			return ctx.targetRepository(dest, repository)
+		},
+		TagPolicy: ctx.TagPolicy,
+		Name:      dest.Name,
+		Report:    ctx.Report,
+		Progress:  ctx.Progress,
+		Observer:  ctx.Observer,
+	})
+	if result != nil {
+		dest.result = *result
+	}
+	return err
 }
 
-func (ctx *ImportContext) uploadManifests() error {
-	var sortedManifests []*ManifestFile
-
-	for _, item := range ctx.manifests {
-		sortedManifests = append(sortedManifests, item)
+// targetRepository returns the repository an archive repository is pushed to
+// on dest, after routing and rewriting.
+func (ctx *ImportContext) targetRepository(dest *Destination, repository string) (string, bool) {
+	repository, ok := dest.repository(repository)
+	if !ok {
+		return "", false
 	}
-	sort.Slice(sortedManifests, func(i, j int) bool {
-		a, b := sortedManifests[i], sortedManifests[j]
-		if a.sortWeight < b.sortWeight {
-			return false
-		}
-		return true
-	})
-
-	for _, item := range sortedManifests {
-		fullName := item.repository
-		if len(item.tag) > 0 {
-			fullName += ":" + item.name
-		} else {
-			fullName += "@" + item.name
-		}
+	return ctx.Rewriter.Rewrite(repository), true
+}
 
-		err := ctx.Registry.PutManifest(item.repository, item.name, item.manifest)
-		if err != nil {
-			log.Printf("Put Manifest "+fullName+" FAILED: ", err)
+// checkRoutes reports archive repositories no destination accepts as
+// failed, as their images are not imported anywhere.
+func (ctx *ImportContext) checkRoutes(destinations []*Destination) {
+	reported := make(map[string]bool)
+	for _, image := range ctx.images {
+		if reported[image.Repository] {
 			continue
 		}
-
-		log.Printf("Put Manifest " + fullName + " SUCCESS")
+		routed := false
+		for _, dest := range destinations {
+			if _, ok := dest.repository(image.Repository); ok {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			reported[image.Repository] = true
+			ctx.emit(&event.Event{Type: event.Notice, Repository: image.Repository, Message: "NO DESTINATION FOR REPOSITORY: " + image.Repository})
+			item := ctx.Report.Track(common.KindRepository, image.Repository)
+			item.Repository = image.Repository
+			item.Done(common.StatusFailed, 0, errors.New("no destination for repository "+image.Repository))
+		}
 	}
-	return nil
 }
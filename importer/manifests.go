@@ -0,0 +1,112 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/discover"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/opencontainers/go-digest"
+)
+
+/*
+ * ManifestRewriter points the image references of Kubernetes manifests at
+ * the registry an archive was imported into, renaming them as the import
+ * does: the archive repository of an image, without its registry unless
+ * IncludeRepoName, is routed to a destination and rewritten by Rewriter.
+ */
+type ManifestRewriter struct {
+	// Destinations are the registries imported into; Name is the host, and
+	// optional port, images are pulled from. An image goes to the first
+	// destination that accepts its repository.
+	Destinations []*Destination
+	Rewriter     *common.Rewriter
+	// IncludeRepoName tells that the archive was exported with
+	// --include-repo-name, so that its repositories start with the source
+	// registry.
+	IncludeRepoName bool
+	// Archive, when set, holds the images imported: references are pinned
+	// to the digest of their tag in it, and images it does not hold are
+	// left as they are.
+	Archive copier.Source
+	// Observer receives a notice for every image left as it is; when it is
+	// nil, they are logged.
+	Observer event.Observer
+}
+
+// Rewrite rewrites the image references of a stream of Kubernetes objects,
+// read from the file name, preserving the rest of data.
+func (r *ManifestRewriter) Rewrite(c context.Context, name string, data []byte) ([]byte, int, error) {
+	out, count, err := discover.RewriteImages(data, func(line int, image string) (string, bool) {
+		rewritten, err := r.Image(c, image)
+		if err != nil {
+			event.Emit(r.Observer, &event.Event{Type: event.Notice, Reference: image, Message: fmt.Sprintf("kept image %s of %s:%d: %v", image, name, line, err)})
+			return "", false
+		}
+		return rewritten, true
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return out, count, nil
+}
+
+// Image returns the reference image is pulled as after the import.
+func (r *ManifestRewriter) Image(c context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	repository := reference.Path(named)
+	if r.IncludeRepoName {
+		repository = reference.Domain(named) + "/" + repository
+	}
+
+	var dest *Destination
+	var target string
+	for _, candidate := range r.Destinations {
+		if routed, ok := candidate.repository(repository); ok {
+			dest, target = candidate, routed
+			break
+		}
+	}
+	if dest == nil {
+		return "", fmt.Errorf("no destination for repository %s", repository)
+	}
+
+	tag := ""
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	var d digest.Digest
+	if digested, ok := named.(reference.Digested); ok {
+		d = digested.Digest()
+	}
+	if r.Archive != nil {
+		lookup := d.String()
+		if len(d) == 0 {
+			lookup = tag
+		}
+		if len(lookup) == 0 {
+			lookup = "latest"
+		}
+		_, payload, err := r.Archive.Manifest(c, repository, lookup)
+		if err != nil {
+			return "", fmt.Errorf("not in the archive: %v", err)
+		}
+		d = digest.FromBytes(payload)
+	}
+
+	result := strings.TrimSuffix(dest.Name, "/") + "/" + r.Rewriter.Rewrite(target)
+	if len(tag) > 0 {
+		result += ":" + tag
+	}
+	if len(d) > 0 {
+		result += "@" + d.String()
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+)
+
+// Options configure Import.
+type Options struct {
+	// Archive is the archive to import, in the format written by
+	// exporter.Export. An *os.File is read in place; other readers are
+	// copied to a temporary file first.
+	Archive io.Reader
+	// Source is imported instead of Archive when it is set, such as a
+	// copier.OCILayoutSource or a copier.DockerArchiveSource.
+	Source copier.Source
+
+	// Registry is the destination when Destinations is empty.
+	Registry *registry.Registry
+	// Destinations the archive is imported into.
+	Destinations []*Destination
+
+	// Rewriter renames the archive repositories; it may be nil.
+	Rewriter *common.Rewriter
+	// TagPolicy is applied in every destination, as copier.Options
+	// documents it.
+	TagPolicy TagPolicy
+
+	// Report, Progress and Observer are shared by the copies into every
+	// destination, as copier.Options documents them. Observer also receives
+	// the start and outcome of every destination.
+	Report   *common.Report
+	Progress *common.Progress
+	Observer event.Observer
+}
+
+// Result is the outcome of Import.
+type Result struct {
+	// Report holds the outcome of every destination, blob, manifest and tag.
+	Report       *common.Report
+	Destinations []DestinationResult
+}
+
+// DestinationResult sums up the import into one destination.
+type DestinationResult struct {
+	Name string
+	// Err is the error that stopped the import into the destination, if
+	// any. Failed items are in the report.
+	Err error
+
+	BlobsUploaded   int
+	BlobsExisting   int
+	BlobsFailed     int
+	BytesUploaded   int64
+	ManifestsPushed int
+	ManifestsFailed int
+	TagConflicts    int
+}
+
+// Failed returns the number of failed items.
+func (r *Result) Failed() int {
+	return r.Report.Failed()
+}
+
+/*
+ * Import the archive of opts into its destinations. Items that fail do not
+ * stop the import and are reported in the result; the returned error is
+ * reserved for invalid options, an archive that cannot be read and the
+ * cancellation of c, in which case the result is still returned.
+ */
+func Import(c context.Context, opts *Options) (*Result, error) {
+	if opts.Archive == nil && opts.Source == nil {
+		return nil, errors.New("no archive to import")
+	}
+	if opts.Registry == nil && len(opts.Destinations) == 0 {
+		return nil, errors.New("no destination registry")
+	}
+
+	ctx := &ImportContext{
+		Registry:     opts.Registry,
+		Rewriter:     opts.Rewriter,
+		TagPolicy:    opts.TagPolicy,
+		Report:       opts.Report,
+		Progress:     opts.Progress,
+		Observer:     opts.Observer,
+		Destinations: opts.Destinations,
+		Source:       opts.Source,
+	}
+	if err := ctx.DoImport(c, opts.Archive); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Report: ctx.Report}
+	for _, dest := range ctx.Destinations {
+		result.Destinations = append(result.Destinations, DestinationResult{
+			Name:            dest.Name,
+			Err:             dest.err,
+			BlobsUploaded:   dest.result.BlobsCopied,
+			BlobsExisting:   dest.result.BlobsExisting,
+			BlobsFailed:     dest.result.BlobsFailed,
+			BytesUploaded:   dest.result.BytesCopied,
+			ManifestsPushed: dest.result.ManifestsPushed,
+			ManifestsFailed: dest.result.ManifestsFailed,
+			TagConflicts:    dest.result.TagConflicts,
+		})
+	}
+	return result, c.Err()
+}
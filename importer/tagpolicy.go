@@ -0,0 +1,21 @@
+package importer
+
+import (
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+)
+
+// TagPolicy and its values are those of copier.TagPolicy, which documents
+// them.
+type TagPolicy = copier.TagPolicy
+
+const (
+	TagPolicyOverwrite = copier.TagPolicyOverwrite
+	TagPolicySkip      = copier.TagPolicySkip
+	TagPolicyFail      = copier.TagPolicyFail
+	TagPolicyRename    = copier.TagPolicyRename
+)
+
+// ParseTagPolicy is copier.ParseTagPolicy.
+func ParseTagPolicy(value string) (TagPolicy, error) {
+	return copier.ParseTagPolicy(value)
+}
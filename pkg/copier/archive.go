@@ -0,0 +1,429 @@
+package copier
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+var regexpManifestFile = regexp.MustCompile("^(.+)/manifests/([^/:]+):(.+)$")
+var regexpTagManifestFile = regexp.MustCompile("^(.+)/manifests/([^/:]+)$")
+var regexpBlobFile = regexp.MustCompile("^blob/([^/:]+):(.+)$")
+
+type archiveManifest struct {
+	repository string
+	reference  string
+	digest     digest.Digest
+	payload    []byte
+}
+
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+/*
+ * ArchiveSource reads images from an archive in the format of this
+ * project: repository/manifests/TAG and repository/manifests/DIGEST entries
+ * holding manifests, and blob/DIGEST entries holding blobs.
+ */
+type ArchiveSource struct {
+	archive     io.ReaderAt
+	archiveSize int64
+	release     func()
+
+	manifests   []*archiveManifest
+	byReference map[string]*archiveManifest
+	blobs       map[digest.Digest]archiveEntry
+}
+
+// NewArchiveSource indexes the archive of size bytes read by archive.
+func NewArchiveSource(archive io.ReaderAt, size int64) (*ArchiveSource, error) {
+	s := &ArchiveSource{
+		archive:     archive,
+		archiveSize: size,
+		release:     func() {},
+	}
+	if err := s.index(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+ * OpenArchiveSource indexes the archive read by archive. Unless it is an
+ * io.ReaderAt and an io.Seeker, such as an *os.File, it is first copied to a
+ * temporary file, which Close removes.
+ */
+func OpenArchiveSource(archive io.Reader) (*ArchiveSource, error) {
+	readerAt, size, release, err := openReaderAt(archive)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewArchiveSource(readerAt, size)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	s.release = release
+	return s, nil
+}
+
+// openReaderAt makes reader readable at any offset, copying it to a
+// temporary file when it is a plain stream. The returned function removes
+// the temporary file.
+func openReaderAt(reader io.Reader) (io.ReaderAt, int64, func(), error) {
+	if readerAt, ok := reader.(io.ReaderAt); ok {
+		// Pipes are files too, which fail to seek.
+		if seeker, ok := reader.(io.Seeker); ok {
+			if size, err := seeker.Seek(0, io.SeekEnd); err == nil {
+				return readerAt, size, func() {}, nil
+			}
+		}
+	}
+
+	file, err := os.CreateTemp("", "docker-registry-importer-*.tar")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	release := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+	return file, size, release, nil
+}
+
+// Close releases the temporary copy of the archive, if any.
+func (s *ArchiveSource) Close() error {
+	s.release()
+	return nil
+}
+
+func (s *ArchiveSource) index() error {
+	s.byReference = make(map[string]*archiveManifest)
+	s.blobs = make(map[digest.Digest]archiveEntry)
+
+	reader := io.NewSectionReader(s.archive, 0, s.archiveSize)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF || header == nil {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if groups := regexpBlobFile.FindStringSubmatch(header.Name); groups != nil {
+			offset, err := reader.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			d := digest.NewDigestFromHex(groups[1], groups[2])
+			s.blobs[d] = archiveEntry{offset: offset, size: header.Size}
+			continue
+		}
+
+		item := &archiveManifest{}
+		if groups := regexpTagManifestFile.FindStringSubmatch(header.Name); groups != nil {
+			item.repository = groups[1]
+			item.reference = groups[2]
+		} else if groups := regexpManifestFile.FindStringSubmatch(header.Name); groups != nil {
+			item.repository = groups[1]
+			item.reference = groups[2] + ":" + groups[3]
+		} else {
+			continue
+		}
+		item.payload, err = io.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		item.digest = digest.FromBytes(item.payload)
+		if d, err := digest.Parse(item.reference); err == nil {
+			item.digest = d
+		}
+		s.manifests = append(s.manifests, item)
+		s.byReference[item.repository+"/manifests/"+item.reference] = item
+		s.byReference[item.repository+"@"+item.digest.String()] = item
+	}
+	return nil
+}
+
+// Images lists the tags of the archive and the manifests stored by digest
+// only that no index of the archive references.
+func (s *ArchiveSource) Images(c context.Context) ([]Image, error) {
+	referenced := make(map[string]bool)
+	tagged := make(map[string]bool)
+	for _, item := range s.manifests {
+		if _, err := digest.Parse(item.reference); err != nil {
+			tagged[item.repository+"@"+item.digest.String()] = true
+		}
+		manifest, _, err := distribution.UnmarshalManifest(manifestMediaType(item.payload), item.payload)
+		if err != nil {
+			continue
+		}
+		for _, reference := range manifest.References() {
+			referenced[item.repository+"@"+reference.Digest.String()] = true
+		}
+	}
+
+	var images []Image
+	for _, item := range s.manifests {
+		key := item.repository + "@" + item.digest.String()
+		if _, err := digest.Parse(item.reference); err == nil && (referenced[key] || tagged[key]) {
+			continue
+		}
+		images = append(images, Image{Repository: item.repository, Reference: item.reference})
+	}
+	return images, nil
+}
+
+// Repositories lists the repositories of the archive, sorted.
+func (s *ArchiveSource) Repositories(c context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	repositories := []string{}
+	for _, item := range s.manifests {
+		if !seen[item.repository] {
+			seen[item.repository] = true
+			repositories = append(repositories, item.repository)
+		}
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// Tags lists the tags of repository in the archive, sorted.
+func (s *ArchiveSource) Tags(c context.Context, repository string) ([]string, error) {
+	found := false
+	tags := []string{}
+	for _, item := range s.manifests {
+		if item.repository != repository {
+			continue
+		}
+		found = true
+		if _, err := digest.Parse(item.reference); err != nil {
+			tags = append(tags, item.reference)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("repository %s: %w", repository, ErrNotFound)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (s *ArchiveSource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	item := s.byReference[repository+"/manifests/"+reference]
+	if item == nil {
+		item = s.byReference[repository+"@"+reference]
+	}
+	if item == nil {
+		return "", nil, fmt.Errorf("manifest %s of %s: %w", reference, repository, ErrNotFound)
+	}
+	return manifestMediaType(item.payload), item.payload, nil
+}
+
+func (s *ArchiveSource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	entry, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, ErrNotFound)
+	}
+	return readSeekNopCloser{io.NewSectionReader(s.archive, entry.offset, entry.size)}, nil
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// ArchiveDestination writes images into an archive in the format read by
+// ArchiveSource. Close completes the archive.
+type ArchiveDestination struct {
+	// TempDir holds blobs while they are checked, before they are written
+	// into the archive. It defaults to the temporary directory of the OS.
+	TempDir string
+
+	writer  *tarWriter
+	written map[string]digest.Digest
+}
+
+func NewArchiveDestination(archive io.Writer) *ArchiveDestination {
+	return &ArchiveDestination{
+		writer:  newTarWriter(archive),
+		written: make(map[string]digest.Digest),
+	}
+}
+
+// HasBlob tells whether the blob was already written into the archive.
+func (d *ArchiveDestination) HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error) {
+	_, ok := d.written["blob/"+desc.Digest.String()]
+	return ok, nil
+}
+
+func (d *ArchiveDestination) PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error {
+	name := "blob/" + desc.Digest.String()
+	if err := d.writer.writeBlob(c, name, d.TempDir, desc, content); err != nil {
+		return err
+	}
+	d.written[name] = desc.Digest
+	return nil
+}
+
+func (d *ArchiveDestination) PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error {
+	name := repository + "/manifests/" + reference
+	manifestDigest := digest.FromBytes(payload)
+	if d.written[name] == manifestDigest {
+		return nil
+	}
+	if err := d.writer.writeFile(name, payload); err != nil {
+		return err
+	}
+	d.written[name] = manifestDigest
+	return nil
+}
+
+// Close writes the end of the archive, but does not close the underlying
+// writer. It fails when an entry could not be written completely.
+func (d *ArchiveDestination) Close() error {
+	return d.writer.Close()
+}
+
+/*
+ * tarWriter writes the entries of an archive. Once an entry could not be
+ * written completely, the archive is corrupt past it, so every later write
+ * fails with the error that broke it.
+ */
+type tarWriter struct {
+	*tar.Writer
+	err error
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{Writer: tar.NewWriter(w)}
+}
+
+func (w *tarWriter) writeFile(name string, data []byte) error {
+	return w.writeEntry(name, int64(len(data)), func() error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+/*
+ * writeBlob writes content, the blob of desc, as the entry name, checking
+ * it against the digest. A content that can seek is local and of a known
+ * size, so it is checked as it is written; another is first copied to a
+ * temporary file in dir and checked, so that a failed transfer never leaves
+ * a truncated or corrupted entry.
+ */
+func (w *tarWriter) writeBlob(c context.Context, name string, dir string, desc distribution.Descriptor, content io.Reader) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	if _, ok := content.(io.Seeker); ok && desc.Size > 0 {
+		return w.writeEntry(name, desc.Size, func() error {
+			size, err := copyVerified(c, w, io.LimitReader(content, desc.Size), desc.Digest)
+			if err == nil && size != desc.Size {
+				err = fmt.Errorf("blob %s has %d bytes rather than %d", desc.Digest, size, desc.Size)
+			}
+			return err
+		})
+	}
+
+	file, err := os.CreateTemp(dir, "blob-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	size, err := copyVerified(c, file, content, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.writeEntry(name, size, func() error {
+		_, err := io.CopyN(w, file, size)
+		return err
+	})
+}
+
+// writeEntry writes the header of a regular file of size bytes, then its
+// content with write.
+func (w *tarWriter) writeEntry(name string, size int64, write func() error) error {
+	if w.err != nil {
+		return fmt.Errorf("archive is broken: %w", w.err)
+	}
+	err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err == nil {
+		err = write()
+	}
+	if err != nil {
+		w.err = fmt.Errorf("%s: %w", name, err)
+	}
+	return err
+}
+
+// Close writes the end of the archive, unless it is broken.
+func (w *tarWriter) Close() error {
+	if w.err != nil {
+		return fmt.Errorf("archive is broken: %w", w.err)
+	}
+	return w.Writer.Close()
+}
+
+// copyVerified copies content to w, failing when it does not match d or c
+// is cancelled.
+func copyVerified(c context.Context, w io.Writer, content io.Reader, d digest.Digest) (int64, error) {
+	if err := d.Validate(); err != nil {
+		return 0, err
+	}
+	verifier := d.Verifier()
+	size, err := io.Copy(io.MultiWriter(w, verifier), contextReader{c, content})
+	if err != nil {
+		return size, err
+	}
+	if !verifier.Verified() {
+		return size, errors.New("blob does not match its digest " + d.String())
+	}
+	return size, nil
+}
+
+// contextReader stops reading once its context is cancelled.
+type contextReader struct {
+	c      context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.c.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,121 @@
+package copier
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/opencontainers/go-digest"
+)
+
+/*
+ * CachedSource keeps the blobs read from Source in Dir, as blob/DIGEST
+ * files, and reads them from there on later copies. A blob is only added to
+ * the cache once it has been read entirely and matches its digest.
+ */
+type CachedSource struct {
+	Source
+	Dir string
+	// Observer receives the notices of invalid cached blobs; when it is nil,
+	// they are logged.
+	Observer event.Observer
+}
+
+// Path returns the file of the blob of digest d in the cache, which holds
+// the blob only once it has been verified.
+func (s *CachedSource) Path(d digest.Digest) string {
+	return filepath.Join(s.Dir, "blob", d.String())
+}
+
+func (s *CachedSource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	filename := s.Path(desc.Digest)
+	dir := filepath.Dir(filename)
+	if file, err := os.Open(filename); err == nil {
+		if checkHash(file, desc.Digest) {
+			if _, err := file.Seek(0, io.SeekStart); err == nil {
+				return file, nil
+			}
+		} else {
+			event.Emit(s.Observer, &event.Event{Type: event.Notice, Repository: repository, Digest: desc.Digest.String(), Message: "cached " + desc.Digest.String() + " invalid"})
+		}
+		file.Close()
+	}
+
+	content, err := s.Source.Blob(c, repository, desc)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return content, nil
+	}
+	file, err := os.CreateTemp(dir, desc.Digest.Encoded()+".*.tmp")
+	if err != nil {
+		return content, nil
+	}
+	return &cacheWriter{
+		content:  content,
+		file:     file,
+		filename: filename,
+		verifier: desc.Digest.Verifier(),
+	}, nil
+}
+
+// cacheWriter copies the blob it reads to a temporary file, which becomes
+// the cached blob once the blob is read entirely and verified.
+type cacheWriter struct {
+	content  io.ReadCloser
+	file     *os.File
+	filename string
+	verifier digest.Verifier
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.content.Read(p)
+	if n > 0 && w.file != nil {
+		if _, werr := w.file.Write(p[:n]); werr != nil {
+			w.discard()
+		} else {
+			_, _ = w.verifier.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	err := w.content.Close()
+	if w.file == nil {
+		return err
+	}
+	if !w.verifier.Verified() {
+		w.discard()
+		return err
+	}
+	if cerr := w.file.Close(); cerr != nil {
+		os.Remove(w.file.Name())
+	} else if rerr := os.Rename(w.file.Name(), w.filename); rerr != nil {
+		os.Remove(w.file.Name())
+	}
+	w.file = nil
+	return err
+}
+
+func (w *cacheWriter) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.file = nil
+}
+
+func checkHash(reader io.Reader, d digest.Digest) bool {
+	if err := d.Validate(); err != nil {
+		return false
+	}
+	hash := d.Algorithm().Hash()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return false
+	}
+	return d.Encoded() == hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,104 @@
+/*
+ * Package copier copies images from any Source to any Destination: a
+ * registry, an archive in the format of this project, an OCI image layout or
+ * a docker-archive, as written by docker save.
+ *
+ * Sources and destinations only store manifests and blobs. Copy resolves the
+ * images, skips the blobs already copied or present, uploads the others once
+ * per repository, and pushes the manifests after everything they reference,
+ * tags last.
+ */
+package copier
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// Image is an image of a source: a repository and a tag or digest.
+type Image struct {
+	Repository string
+	Reference  string
+}
+
+func (i Image) String() string {
+	if _, err := digest.Parse(i.Reference); err == nil {
+		return i.Repository + "@" + i.Reference
+	}
+	return i.Repository + ":" + i.Reference
+}
+
+// ParseImage parses repository:tag or repository@digest; the tag defaults
+// to latest.
+func ParseImage(name string) Image {
+	if at := strings.Index(name, "@"); at >= 0 {
+		return Image{Repository: name[:at], Reference: name[at+1:]}
+	}
+	repository, tag := splitImageName(name)
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+	return Image{Repository: repository, Reference: tag}
+}
+
+// Source is where images are copied from.
+type Source interface {
+	// Images lists the images of the source, which are copied when no image
+	// is given.
+	Images(c context.Context) ([]Image, error)
+	// Manifest returns the media type and the payload of the manifest that
+	// reference, a tag or a digest, points at in repository.
+	Manifest(c context.Context, repository, reference string) (string, []byte, error)
+	// Blob opens the blob of desc in repository. When it is an io.Seeker,
+	// destinations may read it again, for instance to retry an upload.
+	Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error)
+}
+
+// Destination is where images are copied to.
+type Destination interface {
+	// HasBlob tells whether the blob of desc is already in repository.
+	HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error)
+	// PutBlob stores content, the blob of desc, in repository.
+	PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error
+	// PutManifest stores a manifest in repository under reference, a tag or
+	// its digest.
+	PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error
+}
+
+// BlobMounter is a Destination that can link a blob it holds in one
+// repository into another, rather than storing it again.
+type BlobMounter interface {
+	MountBlob(c context.Context, repository, from string, d digest.Digest) error
+}
+
+// TagResolver is a Destination that can tell which manifest a tag points
+// at, so that Copy can apply its TagPolicy.
+type TagResolver interface {
+	// TagDigest returns the digest of the manifest tag points at in
+	// repository, or an empty digest when there is no such tag.
+	TagDigest(c context.Context, repository, tag string) (digest.Digest, error)
+}
+
+// SinglePlatform is a Destination that holds a single platform of every
+// image, such as a docker-archive. Copy stores the manifest of Options.Platform
+// in place of an index.
+type SinglePlatform interface {
+	SinglePlatform() bool
+}
+
+/*
+ * ErrNotFound is returned by sources without the manifest or blob asked
+ * for. IsNotFound also matches the not found errors of registries.
+ */
+var ErrNotFound = errors.New("not found")
+
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist) || registry.IsNotFound(err)
+}
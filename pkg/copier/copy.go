@@ -0,0 +1,792 @@
+package copier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultPlatform is the platform stored in SinglePlatform destinations when
+// Options.Platform is empty.
+const DefaultPlatform = "linux/amd64"
+
+// Options configure Copy.
+type Options struct {
+	// Images to copy. When empty, every image of the source is copied.
+	Images []Image
+	// Rename returns the destination repository of a source repository, or
+	// false to leave the images of the repository out. When it is nil,
+	// repositories keep their names.
+	Rename func(repository string) (string, bool)
+	// TagPolicy resolves tags that already point at a different manifest in
+	// a destination that is a TagResolver. The zero value behaves as
+	// TagPolicyOverwrite.
+	TagPolicy TagPolicy
+	// Platform is the os/arch or os/arch/variant whose manifest replaces an
+	// index in a SinglePlatform destination. It defaults to DefaultPlatform.
+	Platform string
+	// Name identifies the destination in events and report items.
+	Name string
+
+	// Report receives the outcome of every blob, manifest and tag. Copy
+	// creates one when it is nil, and returns it in the Result.
+	Report *common.Report
+	// Progress tracks blob transfers; it may be nil.
+	Progress *common.Progress
+	// Observer receives the events of the copy, from the manifests resolved
+	// to the blobs transferred and the manifests pushed. When it is nil,
+	// they are logged.
+	Observer event.Observer
+}
+
+// Result sums up a copy.
+type Result struct {
+	// Report holds the outcome of every blob, manifest and tag.
+	Report *common.Report
+	// Images holds the outcome of every image copied, in order.
+	Images []ImageResult
+
+	BlobsCopied     int
+	BlobsExisting   int
+	BlobsSkipped    int
+	BlobsFailed     int
+	BytesCopied     int64
+	ManifestsPushed int
+	ManifestsFailed int
+	TagConflicts    int
+}
+
+// ImageResult is the outcome of copying one image.
+type ImageResult struct {
+	Image
+	// Digest of the manifest the image was resolved to.
+	Digest digest.Digest
+	// Err tells why the image was not copied entirely, if it was not.
+	Err error
+}
+
+// Failed tells whether any image, blob or manifest failed.
+func (r *Result) Failed() bool {
+	for _, image := range r.Images {
+		if image.Err != nil {
+			return true
+		}
+	}
+	return r.BlobsFailed > 0 || r.ManifestsFailed > 0
+}
+
+// manifestNode is a manifest of one repository identified by its digest,
+// together with the tags pointing at it and the manifests it references.
+type manifestNode struct {
+	repository string
+	target     string
+	digest     digest.Digest
+	mediaType  string
+	payload    []byte
+	manifest   distribution.Manifest
+	tags       []string
+	children   []*manifestNode
+
+	expanded bool
+	visited  bool
+	pushed   bool
+}
+
+// blobTarget is a blob to store in a repository of the destination.
+type blobTarget struct {
+	source string
+	target string
+	desc   distribution.Descriptor
+	item   *common.ReportItem
+}
+
+type copyContext struct {
+	src    Source
+	dst    Destination
+	opts   *Options
+	result *Result
+
+	nodes       map[string]*manifestNode
+	failedBlobs map[string]bool
+	denied      map[string]error
+	tagErrors   map[string]error
+}
+
+// errForeignLayer tells that a foreign layer is not in the source.
+var errForeignLayer = errors.New("foreign layer not in the source")
+
+/*
+ * Copy the images of opts from src to dst. Every blob is stored once per
+ * destination repository: it is skipped when the destination has it,
+ * mounted from another repository when the destination is a BlobMounter and
+ * uploaded otherwise. Manifests are pushed by digest after the manifests and
+ * blobs they reference, and tags last, only on manifests whose whole tree
+ * was pushed, so a partial copy never leaves a tag pointing at a broken
+ * image.
+ *
+ * Items that fail do not stop the copy and are recorded in the result; the
+ * returned error is reserved for a source that cannot list its images and
+ * the cancellation of c, in which case the result is still returned.
+ */
+func Copy(c context.Context, src Source, dst Destination, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	ctx := &copyContext{
+		src:         src,
+		dst:         dst,
+		opts:        opts,
+		result:      &Result{Report: opts.Report},
+		nodes:       make(map[string]*manifestNode),
+		failedBlobs: make(map[string]bool),
+		denied:      make(map[string]error),
+		tagErrors:   make(map[string]error),
+	}
+	if ctx.result.Report == nil {
+		ctx.result.Report = common.NewReport("copy")
+	}
+
+	images := opts.Images
+	if len(images) == 0 {
+		var err error
+		images, err = src.Images(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var roots []*manifestNode
+	for _, image := range images {
+		target, ok := ctx.target(image.Repository)
+		if !ok {
+			continue
+		}
+		result := ImageResult{Image: image}
+		node, err := ctx.resolveImage(c, image, target)
+		if err != nil {
+			result.Err = err
+			ctx.imageFailed(image, target, err)
+		} else {
+			result.Digest = node.digest
+		}
+		ctx.result.Images = append(ctx.result.Images, result)
+		roots = append(roots, node)
+	}
+
+	ctx.copyBlobs(c, roots)
+	ctx.pushManifests(c, roots)
+
+	for i, node := range roots {
+		result := &ctx.result.Images[i]
+		if node == nil {
+			continue
+		}
+		if !node.pushed {
+			result.Err = errors.New("manifest " + node.digest.String() + " was not copied")
+		} else if err := ctx.tagErrors[node.target+":"+result.Reference]; err != nil {
+			result.Err = err
+		}
+	}
+	return ctx.result, c.Err()
+}
+
+func (ctx *copyContext) emit(e *event.Event) {
+	event.Emit(ctx.opts.Observer, e)
+}
+
+// target returns the destination repository of a source repository.
+func (ctx *copyContext) target(repository string) (string, bool) {
+	if ctx.opts.Rename == nil {
+		return repository, true
+	}
+	return ctx.opts.Rename(repository)
+}
+
+// resolveImage resolves the manifest of image and those it references. For
+// a SinglePlatform destination, an index resolves to the manifest of the
+// platform of the options.
+func (ctx *copyContext) resolveImage(c context.Context, image Image, target string) (*manifestNode, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	node, err := ctx.resolve(c, image.Repository, image.Reference, target)
+	if err != nil {
+		return nil, err
+	}
+	if single, ok := ctx.dst.(SinglePlatform); ok && single.SinglePlatform() {
+		if list, ok := node.manifest.(*manifestlist.DeserializedManifestList); ok {
+			desc, err := selectPlatform(list, ctx.opts.Platform)
+			if err != nil {
+				return nil, err
+			}
+			node, err = ctx.resolve(c, image.Repository, desc.Digest.String(), target)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := ctx.expand(c, node); err != nil {
+		return nil, err
+	}
+	if _, err := digest.Parse(image.Reference); err != nil {
+		found := false
+		for _, tag := range node.tags {
+			found = found || tag == image.Reference
+		}
+		if !found {
+			node.tags = append(node.tags, image.Reference)
+		}
+	}
+	return node, nil
+}
+
+// imageFailed reports an image whose manifests could not be resolved.
+func (ctx *copyContext) imageFailed(image Image, target string, err error) {
+	separator := ":"
+	if _, err := digest.Parse(image.Reference); err == nil {
+		separator = "@"
+	}
+	item := ctx.result.Report.Track(common.KindManifest, target+separator+image.Reference)
+	item.Repository = target
+	item.Destination = ctx.opts.Name
+	if target != image.Repository {
+		item.Note("from " + image.String())
+	}
+	ctx.manifestDone(item, common.StatusFailed, err)
+}
+
+// resolve reads the manifest reference points at in repository, once per
+// digest.
+func (ctx *copyContext) resolve(c context.Context, repository, reference, target string) (*manifestNode, error) {
+	mediaType, payload, err := ctx.src.Manifest(c, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	d := digest.FromBytes(payload)
+	if expected, err := digest.Parse(reference); err == nil {
+		if d = expected.Algorithm().FromBytes(payload); d != expected {
+			return nil, fmt.Errorf("manifest %s@%s has digest %s", repository, expected, d)
+		}
+	}
+
+	key := repository + "@" + d.String()
+	if node := ctx.nodes[key]; node != nil {
+		return node, nil
+	}
+
+	if len(mediaType) == 0 {
+		mediaType = manifestMediaType(payload)
+	}
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s@%s: %w", repository, d, err)
+	}
+	ctx.emit(&event.Event{
+		Type:       event.ManifestResolved,
+		Repository: repository,
+		Reference:  reference,
+		Digest:     d.String(),
+		MediaType:  mediaType,
+		Size:       int64(len(payload)),
+	})
+
+	node := &manifestNode{
+		repository: repository,
+		target:     target,
+		digest:     d,
+		mediaType:  mediaType,
+		payload:    payload,
+		manifest:   manifest,
+	}
+	ctx.nodes[key] = node
+	return node, nil
+}
+
+// expand resolves the manifests an index references.
+func (ctx *copyContext) expand(c context.Context, node *manifestNode) error {
+	if node.expanded {
+		return nil
+	}
+	node.expanded = true
+	if !isIndex(node) {
+		return nil
+	}
+	for _, reference := range node.manifest.References() {
+		if err := c.Err(); err != nil {
+			return err
+		}
+		child, err := ctx.resolve(c, node.repository, reference.Digest.String(), node.target)
+		if err != nil {
+			return err
+		}
+		if child == node {
+			continue
+		}
+		if err := ctx.expand(c, child); err != nil {
+			return err
+		}
+		node.children = append(node.children, child)
+	}
+	return nil
+}
+
+func isIndex(node *manifestNode) bool {
+	_, ok := node.manifest.(*manifestlist.DeserializedManifestList)
+	return ok
+}
+
+// manifestMediaType guesses the media type of a manifest that does not
+// come with one: from its mediaType field, or for OCI manifests, which may
+// omit it, from its fields.
+func manifestMediaType(payload []byte) string {
+	var fields struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return ""
+	}
+	switch {
+	case len(fields.MediaType) > 0:
+		return fields.MediaType
+	case fields.SchemaVersion == 1:
+		return schema1.MediaTypeSignedManifest
+	case len(fields.Manifests) > 0:
+		return v1.MediaTypeImageIndex
+	}
+	return v1.MediaTypeImageManifest
+}
+
+// selectPlatform returns the manifest of an index for platform, given as
+// os/arch or os/arch/variant.
+func selectPlatform(list *manifestlist.DeserializedManifestList, platform string) (distribution.Descriptor, error) {
+	if len(platform) == 0 {
+		platform = DefaultPlatform
+	}
+	tokens := strings.Split(platform, "/")
+	if len(tokens) < 2 || len(tokens) > 3 {
+		return distribution.Descriptor{}, errors.New("invalid platform (expected os/arch or os/arch/variant): " + platform)
+	}
+	for _, manifest := range list.Manifests {
+		if manifest.Platform.OS != tokens[0] || manifest.Platform.Architecture != tokens[1] {
+			continue
+		}
+		if len(tokens) == 3 && manifest.Platform.Variant != tokens[2] {
+			continue
+		}
+		return manifest.Descriptor, nil
+	}
+	return distribution.Descriptor{}, errors.New("no manifest for platform " + platform)
+}
+
+// copyBlobs stores the blobs of the leaf manifests of roots, digest by
+// digest in the order the manifests reference them.
+func (ctx *copyContext) copyBlobs(c context.Context, roots []*manifestNode) {
+	var digests []digest.Digest
+	targets := make(map[digest.Digest][]*blobTarget)
+	seen := make(map[string]bool)
+	visited := make(map[*manifestNode]bool)
+
+	var walk func(node *manifestNode)
+	walk = func(node *manifestNode) {
+		if node == nil || visited[node] {
+			return
+		}
+		visited[node] = true
+		if isIndex(node) {
+			for _, child := range node.children {
+				walk(child)
+			}
+			return
+		}
+		for _, desc := range node.manifest.References() {
+			key := node.target + "@" + desc.Digest.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if targets[desc.Digest] == nil {
+				digests = append(digests, desc.Digest)
+				ctx.opts.Progress.AddTotal(desc.Size)
+			}
+			targets[desc.Digest] = append(targets[desc.Digest], &blobTarget{
+				source: node.repository,
+				target: node.target,
+				desc:   desc,
+			})
+		}
+	}
+	for _, node := range roots {
+		walk(node)
+	}
+
+	for _, d := range digests {
+		if c.Err() != nil {
+			return
+		}
+		ctx.copyBlob(c, targets[d])
+	}
+}
+
+// copyBlob stores a blob in every repository of targets that lacks it.
+func (ctx *copyContext) copyBlob(c context.Context, targets []*blobTarget) {
+	var pending []*blobTarget
+	for _, t := range targets {
+		t.item = ctx.trackBlob(t)
+		if err := ctx.deniedError(t.target); err != nil {
+			ctx.blobDone(t.item, common.StatusFailed, 0, err)
+			continue
+		}
+		has, err := ctx.dst.HasBlob(c, t.target, t.desc)
+		if err != nil {
+			ctx.deny(t.target, err)
+		}
+		if has {
+			ctx.blobDone(t.item, common.StatusExists, 0, nil)
+		} else if err := ctx.deniedError(t.target); err != nil {
+			ctx.blobDone(t.item, common.StatusFailed, 0, err)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	if len(pending) == 0 {
+		ctx.opts.Progress.Complete(targets[0].desc.Size)
+		return
+	}
+	ctx.transferBlob(c, pending)
+}
+
+// transferBlob uploads the blob into the repository of the first target and
+// mounts it into the remaining ones, uploading it again where the mount is
+// refused.
+func (ctx *copyContext) transferBlob(c context.Context, targets []*blobTarget) {
+	mounter, _ := ctx.dst.(BlobMounter)
+	source := ""
+	for _, t := range targets {
+		d := t.desc.Digest
+		if err := c.Err(); err != nil {
+			ctx.blobDone(t.item, common.StatusFailed, 0, err)
+			continue
+		}
+		if err := ctx.deniedError(t.target); err != nil {
+			ctx.blobDone(t.item, common.StatusFailed, 0, err)
+			continue
+		}
+		if len(source) > 0 && mounter != nil {
+			err := mounter.MountBlob(c, t.target, source, d)
+			if err == nil {
+				t.item.Note("mounted from " + source)
+				ctx.blobDone(t.item, common.StatusSuccess, 0, nil)
+				continue
+			}
+			ctx.emit(&event.Event{Type: event.Notice, Destination: ctx.opts.Name, Repository: t.target, Digest: d.String(), From: source, Message: "MOUNT FROM " + source + " FAILED", Err: err})
+		} else if len(source) > 0 {
+			// Archives and layouts share blobs between repositories.
+			if has, _ := ctx.dst.HasBlob(c, t.target, t.desc); has {
+				ctx.blobDone(t.item, common.StatusExists, 0, nil)
+				continue
+			}
+		}
+
+		err := ctx.putBlob(c, t)
+		switch {
+		case err == nil:
+			ctx.blobDone(t.item, common.StatusSuccess, t.desc.Size, nil)
+			if len(source) == 0 {
+				source = t.target
+			}
+		case errors.Is(err, errForeignLayer):
+			// Foreign layers, such as Windows base layers, are served
+			// from their URLs rather than the registry.
+			t.item.Note(err.Error())
+			ctx.opts.Progress.Complete(t.desc.Size)
+			ctx.blobDone(t.item, common.StatusSkipped, 0, nil)
+		default:
+			ctx.deny(t.target, err)
+			ctx.blobDone(t.item, common.StatusFailed, 0, err)
+		}
+	}
+}
+
+// putBlob copies the blob of t from the source to the destination.
+func (ctx *copyContext) putBlob(c context.Context, t *blobTarget) error {
+	content, err := ctx.src.Blob(c, t.source, t.desc)
+	if err != nil {
+		if len(t.desc.URLs) > 0 && IsNotFound(err) {
+			return errForeignLayer
+		}
+		return err
+	}
+	defer content.Close()
+
+	d := t.desc.Digest.String()
+	blobEvent := event.Event{Destination: ctx.opts.Name, Repository: t.target, Digest: d, MediaType: t.desc.MediaType, Size: t.desc.Size}
+	started := blobEvent
+	started.Type = event.BlobStarted
+	ctx.emit(&started)
+	transfer := ctx.opts.Progress.Start(d, common.ShortDigest(d)+" "+t.target, t.desc.Size)
+	reader := event.Reader(ctx.opts.Observer, blobEvent, transfer.Reader(io.Reader(content)))
+	err = ctx.dst.PutBlob(c, t.target, t.desc, reader)
+	transfer.Done(err)
+	return err
+}
+
+func (ctx *copyContext) trackBlob(t *blobTarget) *common.ReportItem {
+	item := ctx.result.Report.Track(common.KindBlob, t.target+"@"+t.desc.Digest.String())
+	item.Repository = t.target
+	item.Digest = t.desc.Digest.String()
+	item.Destination = ctx.opts.Name
+	return item
+}
+
+// blobDone emits the outcome of storing a blob and records it in the report
+// and the result.
+func (ctx *copyContext) blobDone(item *common.ReportItem, status common.ItemStatus, bytes int64, err error) {
+	e := &event.Event{
+		Destination: ctx.opts.Name,
+		Repository:  item.Repository,
+		Digest:      item.Digest,
+		Bytes:       bytes,
+		Message:     item.Message,
+		Err:         err,
+	}
+	switch status {
+	case common.StatusFailed:
+		e.Type = event.BlobFailed
+		ctx.failedBlobs[item.Repository+"@"+item.Digest] = true
+		ctx.result.BlobsFailed++
+	case common.StatusExists:
+		e.Type = event.BlobSkipped
+		e.Message = "already exists"
+		ctx.result.BlobsExisting++
+	case common.StatusSkipped:
+		e.Type = event.BlobSkipped
+		ctx.result.BlobsSkipped++
+	default:
+		e.Type = event.BlobDone
+		ctx.result.BlobsCopied++
+		ctx.result.BytesCopied += bytes
+	}
+	ctx.emit(e)
+	item.Done(status, bytes, err)
+}
+
+// deny records that the destination refused access to repository with err,
+// if err is such a refusal, so that nothing more is sent to the repository.
+func (ctx *copyContext) deny(repository string, err error) {
+	if !errors.Is(err, registry.ErrUnauthorized) && !errors.Is(err, registry.ErrDenied) {
+		return
+	}
+	if ctx.denied[repository] == nil {
+		ctx.emit(&event.Event{
+			Type:        event.Notice,
+			Destination: ctx.opts.Name,
+			Repository:  repository,
+			Message:     strings.TrimSpace("ACCESS DENIED TO " + ctx.opts.Name + " " + repository),
+			Err:         err,
+		})
+		ctx.denied[repository] = err
+	}
+}
+
+// deniedError returns the refusal recorded for repository, if any.
+func (ctx *copyContext) deniedError(repository string) error {
+	if err := ctx.denied[repository]; err != nil {
+		return fmt.Errorf("access denied: %w", err)
+	}
+	return nil
+}
+
+// pushManifests pushes the manifests of roots by digest after the manifests
+// they reference, so leaf manifests go first and indexes follow, then their
+// tags.
+func (ctx *copyContext) pushManifests(c context.Context, roots []*manifestNode) {
+	var push func(node *manifestNode) bool
+	push = func(node *manifestNode) bool {
+		if node.visited {
+			return node.pushed
+		}
+		if c.Err() != nil {
+			return false
+		}
+		node.visited = true
+
+		item := ctx.trackManifest(node, common.KindManifest, node.digest.String(), "@")
+		complete := true
+		for _, child := range node.children {
+			if !push(child) {
+				complete = false
+			}
+		}
+		if !complete {
+			ctx.manifestDone(item, common.StatusFailed, errors.New("a referenced manifest was not pushed"))
+			return false
+		}
+
+		if !isIndex(node) {
+			for _, reference := range node.manifest.References() {
+				if ctx.failedBlobs[node.target+"@"+reference.Digest.String()] {
+					ctx.manifestDone(item, common.StatusFailed, errors.New("blob "+reference.Digest.String()+" was not copied"))
+					return false
+				}
+			}
+		}
+
+		node.pushed = ctx.putManifest(c, item, node, node.digest.String()) == nil
+		return node.pushed
+	}
+
+	for _, node := range roots {
+		if node != nil {
+			push(node)
+		}
+	}
+
+	done := make(map[*manifestNode]bool)
+	for _, node := range roots {
+		if node == nil || done[node] {
+			continue
+		}
+		done[node] = true
+		for _, tag := range node.tags {
+			if c.Err() != nil {
+				return
+			}
+			key := node.target + ":" + tag
+			if !node.pushed {
+				item := ctx.trackManifest(node, common.KindTag, tag, ":")
+				ctx.tagErrors[key] = errors.New(node.digest.String() + " was not pushed")
+				ctx.manifestDone(item, common.StatusFailed, ctx.tagErrors[key])
+				continue
+			}
+			ctx.tagErrors[key] = ctx.putTag(c, node, tag)
+		}
+	}
+}
+
+func (ctx *copyContext) trackManifest(node *manifestNode, kind string, reference string, separator string) *common.ReportItem {
+	item := ctx.result.Report.Track(kind, node.target+separator+reference)
+	item.Repository = node.target
+	item.Digest = node.digest.String()
+	item.Destination = ctx.opts.Name
+	if node.target != node.repository {
+		item.Note("from " + node.repository + separator + reference)
+	}
+	return item
+}
+
+// putTag applies tag on the manifest of node. A tag that already points at
+// a different manifest in a TagResolver destination is a conflict, which is
+// reported and resolved according to the tag policy. It returns the error
+// that made the tag fail, if any.
+func (ctx *copyContext) putTag(c context.Context, node *manifestNode, tag string) error {
+	item := ctx.trackManifest(node, common.KindTag, tag, ":")
+	repository := node.target
+
+	if resolver, ok := ctx.dst.(TagResolver); ok {
+		existing, err := resolver.TagDigest(c, repository, tag)
+		if err != nil {
+			err = fmt.Errorf("checking existing tag: %v", err)
+			ctx.manifestDone(item, common.StatusFailed, err)
+			return err
+		}
+
+		if len(existing) > 0 && existing != node.digest {
+			ctx.result.TagConflicts++
+			conflict := func(resolution string) {
+				ctx.emit(&event.Event{
+					Type:        event.TagConflict,
+					Destination: ctx.opts.Name,
+					Repository:  repository,
+					Reference:   tag,
+					Digest:      node.digest.String(),
+					Message:     "existing=" + existing.String() + " source=" + node.digest.String() + " " + resolution,
+				})
+			}
+			item.Note("conflict with existing " + existing.String())
+			switch ctx.opts.TagPolicy {
+			case TagPolicySkip:
+				conflict("SKIPPED")
+				ctx.manifestDone(item, common.StatusSkipped, nil)
+				return nil
+			case TagPolicyFail:
+				conflict("FAILED")
+				err := errors.New("tag exists with digest " + existing.String())
+				ctx.manifestDone(item, common.StatusFailed, err)
+				return err
+			case TagPolicyRename:
+				renamed := renamedTag(tag, node.digest)
+				conflict("RENAMED TO " + renamed)
+				item.Name = repository + ":" + renamed
+				item.Note("renamed from " + tag)
+				tag = renamed
+			default:
+				conflict("OVERWRITTEN")
+				item.Note("overwritten")
+			}
+		}
+	}
+
+	return ctx.putManifest(c, item, node, tag)
+}
+
+func (ctx *copyContext) putManifest(c context.Context, item *common.ReportItem, node *manifestNode, reference string) error {
+	if err := ctx.deniedError(item.Repository); err != nil {
+		ctx.manifestDone(item, common.StatusFailed, err)
+		return err
+	}
+	err := ctx.dst.PutManifest(c, item.Repository, reference, node.mediaType, node.payload)
+	if err != nil {
+		ctx.deny(item.Repository, err)
+		switch {
+		case errors.Is(err, registry.ErrManifestBlobUnknown):
+			item.Note("the registry is missing a blob the manifest references")
+		case errors.Is(err, registry.ErrManifestInvalid), errors.Is(err, registry.ErrUnsupported):
+			item.Note("the registry may not support " + node.mediaType)
+		}
+		ctx.manifestDone(item, common.StatusFailed, err)
+		return err
+	}
+	item.Bytes = int64(len(node.payload))
+	ctx.manifestDone(item, common.StatusSuccess, nil)
+	return nil
+}
+
+// manifestDone emits the outcome of pushing a manifest or tag and records it
+// in the report and the result.
+func (ctx *copyContext) manifestDone(item *common.ReportItem, status common.ItemStatus, err error) {
+	e := &event.Event{
+		Destination: ctx.opts.Name,
+		Repository:  item.Repository,
+		Reference:   item.Name[len(item.Repository)+1:],
+		Digest:      item.Digest,
+		Size:        item.Bytes,
+		Message:     item.Message,
+		Err:         err,
+	}
+	switch status {
+	case common.StatusFailed:
+		e.Type = event.ManifestFailed
+		ctx.result.ManifestsFailed++
+	case common.StatusSkipped:
+		e.Type = event.ManifestSkipped
+	default:
+		e.Type = event.ManifestPushed
+		ctx.result.ManifestsPushed++
+	}
+	ctx.emit(e)
+	item.Done(status, item.Bytes, err)
+}
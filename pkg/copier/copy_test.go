@@ -0,0 +1,331 @@
+package copier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// memorySource is a Source holding manifests by repository and reference,
+// and blobs by digest.
+type memorySource struct {
+	images    []Image
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+}
+
+func (s *memorySource) Images(c context.Context) ([]Image, error) {
+	return s.images, nil
+}
+
+func (s *memorySource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	payload, ok := s.manifests[repository+"@"+reference]
+	if !ok {
+		return "", nil, fmt.Errorf("manifest %s of %s: %w", reference, repository, ErrNotFound)
+	}
+	return "", payload, nil
+}
+
+func (s *memorySource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	data, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memorySource) blob(data string) distribution.Descriptor {
+	d := digest.FromString(data)
+	s.blobs[d] = []byte(data)
+	return distribution.Descriptor{MediaType: schema2.MediaTypeLayer, Digest: d, Size: int64(len(data))}
+}
+
+// manifest stores payload in repository under its digest and tags.
+func (s *memorySource) manifest(repository string, payload []byte, tags ...string) distribution.Descriptor {
+	d := digest.FromBytes(payload)
+	s.manifests[repository+"@"+d.String()] = payload
+	for _, tag := range tags {
+		s.manifests[repository+"@"+tag] = payload
+		s.images = append(s.images, Image{Repository: repository, Reference: tag})
+	}
+	return distribution.Descriptor{MediaType: manifestMediaType(payload), Digest: d, Size: int64(len(payload))}
+}
+
+// image stores a schema2 manifest with a configuration made of name and
+// layers.
+func (s *memorySource) image(t *testing.T, repository, name string, layers []distribution.Descriptor, tags ...string) distribution.Descriptor {
+	config := s.blob(`{"name":"` + name + `"}`)
+	config.MediaType = schema2.MediaTypeImageConfig
+	manifest, err := schema2.FromStruct(schema2.Manifest{Versioned: schema2.SchemaVersion, Config: config, Layers: layers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := manifest.Payload()
+	return s.manifest(repository, payload, tags...)
+}
+
+func (s *memorySource) index(t *testing.T, repository string, children []distribution.Descriptor, tags ...string) distribution.Descriptor {
+	var descriptors []manifestlist.ManifestDescriptor
+	for i, child := range children {
+		descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+			Descriptor: child,
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: fmt.Sprintf("arch%d", i)},
+		})
+	}
+	list, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := list.Payload()
+	return s.manifest(repository, payload, tags...)
+}
+
+// memoryDestination is a Destination recording the operations it is asked
+// for, such as "blob a sha256:..." or "manifest a v1".
+type memoryDestination struct {
+	blobs      map[string]bool
+	operations []string
+	// denied repositories refuse every write with registry.ErrDenied.
+	denied map[string]bool
+	// names shortens the digests of the operations.
+	names map[digest.Digest]string
+}
+
+func newMemoryDestination(names map[digest.Digest]string) *memoryDestination {
+	return &memoryDestination{blobs: make(map[string]bool), denied: make(map[string]bool), names: names}
+}
+
+func (d *memoryDestination) name(reference string) string {
+	if name, ok := d.names[digest.Digest(reference)]; ok {
+		return name
+	}
+	return reference
+}
+
+func (d *memoryDestination) HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error) {
+	return d.blobs[repository+"@"+desc.Digest.String()], nil
+}
+
+func (d *memoryDestination) PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error {
+	d.operations = append(d.operations, "blob "+repository+" "+d.name(desc.Digest.String()))
+	if d.denied[repository] {
+		return registry.ErrDenied
+	}
+	if _, err := copyVerified(c, io.Discard, content, desc.Digest); err != nil {
+		return err
+	}
+	d.blobs[repository+"@"+desc.Digest.String()] = true
+	return nil
+}
+
+func (d *memoryDestination) PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error {
+	d.operations = append(d.operations, "manifest "+repository+" "+d.name(reference))
+	if d.denied[repository] {
+		return registry.ErrDenied
+	}
+	return nil
+}
+
+// mountingDestination is a memoryDestination that is a BlobMounter, which
+// refuses mounts when refuse is set.
+type mountingDestination struct {
+	*memoryDestination
+	refuse bool
+}
+
+func (d *mountingDestination) MountBlob(c context.Context, repository, from string, dgst digest.Digest) error {
+	d.operations = append(d.operations, "mount "+repository+" "+d.name(dgst.String())+" from "+from)
+	if d.refuse {
+		return registry.ErrUnsupported
+	}
+	d.blobs[repository+"@"+dgst.String()] = true
+	return nil
+}
+
+func TestCopy(t *testing.T) {
+	type counts struct {
+		copied, existing, skipped, failed, pushed, manifestsFailed int
+	}
+	tests := []struct {
+		name string
+		// setup fills the source, names its digests and returns the
+		// destination.
+		setup      func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination
+		operations []string
+		counts     counts
+	}{
+		{
+			name: "image pushes blobs, then the manifest by digest, then tags",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				layer := src.blob("layer")
+				names[layer.Digest] = "layer"
+				image := src.image(t, "a", "image", []distribution.Descriptor{layer}, "v1", "latest")
+				names[image.Digest] = "image"
+				names[digest.FromString(`{"name":"image"}`)] = "config"
+				return newMemoryDestination(names)
+			},
+			operations: []string{
+				"blob a config",
+				"blob a layer",
+				"manifest a image",
+				"manifest a v1",
+				"manifest a latest",
+			},
+			counts: counts{copied: 2, pushed: 3},
+		},
+		{
+			name: "index is pushed after its children, tags last",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				first := src.image(t, "a", "first", nil)
+				second := src.image(t, "a", "second", nil)
+				index := src.index(t, "a", []distribution.Descriptor{first, second}, "v1")
+				names[first.Digest], names[second.Digest], names[index.Digest] = "first", "second", "index"
+				names[digest.FromString(`{"name":"first"}`)] = "config1"
+				names[digest.FromString(`{"name":"second"}`)] = "config2"
+				return newMemoryDestination(names)
+			},
+			operations: []string{
+				"blob a config1",
+				"blob a config2",
+				"manifest a first",
+				"manifest a second",
+				"manifest a index",
+				"manifest a v1",
+			},
+			counts: counts{copied: 2, pushed: 4},
+		},
+		{
+			name: "foreign layer missing from the source is skipped",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				foreign := distribution.Descriptor{
+					MediaType: schema2.MediaTypeForeignLayer,
+					Digest:    digest.FromString("foreign"),
+					Size:      7,
+					URLs:      []string{"https://example.com/foreign.tar.gz"},
+				}
+				image := src.image(t, "a", "image", []distribution.Descriptor{foreign}, "v1")
+				names[image.Digest] = "image"
+				names[digest.FromString(`{"name":"image"}`)] = "config"
+				return newMemoryDestination(names)
+			},
+			operations: []string{
+				"blob a config",
+				"manifest a image",
+				"manifest a v1",
+			},
+			counts: counts{copied: 1, skipped: 1, pushed: 2},
+		},
+		{
+			name: "blob shared by repositories is uploaded once and mounted",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				layer := src.blob("layer")
+				names[layer.Digest] = "layer"
+				names[src.image(t, "a", "image", []distribution.Descriptor{layer}, "v1").Digest] = "image"
+				src.image(t, "b", "image", []distribution.Descriptor{layer}, "v1")
+				names[digest.FromString(`{"name":"image"}`)] = "config"
+				return &mountingDestination{memoryDestination: newMemoryDestination(names)}
+			},
+			operations: []string{
+				"blob a config",
+				"mount b config from a",
+				"blob a layer",
+				"mount b layer from a",
+				"manifest a image",
+				"manifest b image",
+				"manifest a v1",
+				"manifest b v1",
+			},
+			counts: counts{copied: 4, pushed: 4},
+		},
+		{
+			name: "refused mount falls back to an upload",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				layer := src.blob("layer")
+				names[layer.Digest] = "layer"
+				names[src.image(t, "a", "image", []distribution.Descriptor{layer}, "v1").Digest] = "image"
+				src.image(t, "b", "image", []distribution.Descriptor{layer}, "v1")
+				names[digest.FromString(`{"name":"image"}`)] = "config"
+				return &mountingDestination{memoryDestination: newMemoryDestination(names), refuse: true}
+			},
+			operations: []string{
+				"blob a config",
+				"mount b config from a",
+				"blob b config",
+				"blob a layer",
+				"mount b layer from a",
+				"blob b layer",
+				"manifest a image",
+				"manifest b image",
+				"manifest a v1",
+				"manifest b v1",
+			},
+			counts: counts{copied: 4, pushed: 4},
+		},
+		{
+			name: "denied repository is not written to again",
+			setup: func(t *testing.T, src *memorySource, names map[digest.Digest]string) Destination {
+				layer := src.blob("layer")
+				names[layer.Digest] = "layer"
+				names[src.image(t, "denied", "image", []distribution.Descriptor{layer}, "v1").Digest] = "image"
+				src.image(t, "a", "image", []distribution.Descriptor{layer}, "v1")
+				names[digest.FromString(`{"name":"image"}`)] = "config"
+				dst := newMemoryDestination(names)
+				dst.denied["denied"] = true
+				return dst
+			},
+			operations: []string{
+				"blob denied config",
+				"blob a config",
+				"blob a layer",
+				"manifest a image",
+				"manifest a v1",
+			},
+			counts: counts{copied: 2, failed: 2, pushed: 2, manifestsFailed: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newMemorySource()
+			names := make(map[digest.Digest]string)
+			dst := test.setup(t, src, names)
+
+			result, err := Copy(context.Background(), src, dst, &Options{Observer: event.Func(func(*event.Event) {})})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var operations []string
+			switch typed := dst.(type) {
+			case *memoryDestination:
+				operations = typed.operations
+			case *mountingDestination:
+				operations = typed.operations
+			}
+			if !reflect.DeepEqual(operations, test.operations) {
+				t.Errorf("operations:\n got %q\nwant %q", operations, test.operations)
+			}
+			got := counts{result.BlobsCopied, result.BlobsExisting, result.BlobsSkipped, result.BlobsFailed, result.ManifestsPushed, result.ManifestsFailed}
+			if got != test.counts {
+				t.Errorf("counts: got %+v, want %+v", got, test.counts)
+			}
+		})
+	}
+}
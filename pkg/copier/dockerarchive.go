@@ -0,0 +1,338 @@
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+const dockerArchiveManifestFile = "manifest.json"
+
+// dockerArchiveImage is an entry of the manifest.json of a docker-archive.
+type dockerArchiveImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type dockerArchiveManifest struct {
+	tags    []string
+	digest  digest.Digest
+	payload []byte
+}
+
+/*
+ * DockerArchiveSource reads images from a docker-archive, the tar archive
+ * written by docker save. Its images have schema2 manifests built from the
+ * configurations and layers of the archive; layers are labelled compressed
+ * when they are gzip streams and uncompressed otherwise.
+ */
+type DockerArchiveSource struct {
+	// Repository of the images without a tag. It defaults to "image".
+	Repository string
+
+	archive io.ReaderAt
+	release func()
+
+	manifests []*dockerArchiveManifest
+	blobs     map[digest.Digest]archiveEntry
+}
+
+// NewDockerArchiveSource indexes the docker-archive of size bytes read by
+// archive, reading every layer to compute its digest.
+func NewDockerArchiveSource(archive io.ReaderAt, size int64) (*DockerArchiveSource, error) {
+	s := &DockerArchiveSource{
+		archive: archive,
+		release: func() {},
+		blobs:   make(map[digest.Digest]archiveEntry),
+	}
+	if err := s.index(size); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenDockerArchiveSource indexes the docker-archive read by archive,
+// copying it first to a temporary file as OpenArchiveSource does.
+func OpenDockerArchiveSource(archive io.Reader) (*DockerArchiveSource, error) {
+	readerAt, size, release, err := openReaderAt(archive)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewDockerArchiveSource(readerAt, size)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	s.release = release
+	return s, nil
+}
+
+// Close releases the temporary copy of the archive, if any.
+func (s *DockerArchiveSource) Close() error {
+	s.release()
+	return nil
+}
+
+func (s *DockerArchiveSource) index(size int64) error {
+	entries := make(map[string]archiveEntry)
+	reader := io.NewSectionReader(s.archive, 0, size)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF || header == nil {
+			break
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		entries[path.Clean(header.Name)] = archiveEntry{offset: offset, size: header.Size}
+	}
+
+	entry, ok := entries[dockerArchiveManifestFile]
+	if !ok {
+		return errors.New("not a docker-archive: no " + dockerArchiveManifestFile)
+	}
+	var images []dockerArchiveImage
+	if err := json.NewDecoder(s.section(entry)).Decode(&images); err != nil {
+		return fmt.Errorf("%s: %v", dockerArchiveManifestFile, err)
+	}
+
+	for _, image := range images {
+		config, err := s.descriptor(entries, image.Config, schema2.MediaTypeImageConfig)
+		if err != nil {
+			return err
+		}
+		manifest := schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    config,
+		}
+		for _, layer := range image.Layers {
+			desc, err := s.descriptor(entries, layer, "")
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		deserialized, err := schema2.FromStruct(manifest)
+		if err != nil {
+			return err
+		}
+		_, payload, err := deserialized.Payload()
+		if err != nil {
+			return err
+		}
+		s.manifests = append(s.manifests, &dockerArchiveManifest{
+			tags:    image.RepoTags,
+			digest:  digest.FromBytes(payload),
+			payload: payload,
+		})
+	}
+	return nil
+}
+
+func (s *DockerArchiveSource) section(entry archiveEntry) *io.SectionReader {
+	return io.NewSectionReader(s.archive, entry.offset, entry.size)
+}
+
+// descriptor returns the descriptor of the blob at name, reading it to
+// compute its digest. Layers get the media type of their compression.
+func (s *DockerArchiveSource) descriptor(entries map[string]archiveEntry, name string, mediaType string) (distribution.Descriptor, error) {
+	entry, ok := entries[path.Clean(name)]
+	if !ok {
+		return distribution.Descriptor{}, errors.New("not in the docker-archive: " + name)
+	}
+	if len(mediaType) == 0 {
+		var err error
+		if mediaType, err = s.layerMediaType(entry); err != nil {
+			return distribution.Descriptor{}, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	d, err := digest.FromReader(s.section(entry))
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	s.blobs[d] = entry
+	return distribution.Descriptor{MediaType: mediaType, Digest: d, Size: entry.size}, nil
+}
+
+// gzipMagic starts a gzip stream, as docker load detects compressed layers.
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// layerMediaType returns the media type of a layer: compressed when it is a
+// gzip stream, uncompressed otherwise, as docker save writes them.
+func (s *DockerArchiveSource) layerMediaType(entry archiveEntry) (string, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, err := s.section(entry).ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if n == len(gzipMagic) && bytes.Equal(magic, gzipMagic) {
+		return schema2.MediaTypeLayer, nil
+	}
+	return schema2.MediaTypeUncompressedLayer, nil
+}
+
+func (s *DockerArchiveSource) repository() string {
+	if len(s.Repository) > 0 {
+		return s.Repository
+	}
+	return "image"
+}
+
+// Images lists the tags of the archive, and the digests of the images
+// without a tag.
+func (s *DockerArchiveSource) Images(c context.Context) ([]Image, error) {
+	var images []Image
+	for _, manifest := range s.manifests {
+		for _, name := range manifest.tags {
+			repository, tag := splitImageName(name)
+			if len(tag) == 0 {
+				tag = "latest"
+			}
+			images = append(images, Image{Repository: repository, Reference: tag})
+		}
+		if len(manifest.tags) == 0 {
+			images = append(images, Image{Repository: s.repository(), Reference: manifest.digest.String()})
+		}
+	}
+	return images, nil
+}
+
+func (s *DockerArchiveSource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	for _, manifest := range s.manifests {
+		if manifest.digest.String() == reference {
+			return schema2.MediaTypeManifest, manifest.payload, nil
+		}
+		for _, name := range manifest.tags {
+			if name == repository+":"+reference || reference == "latest" && name == repository {
+				return schema2.MediaTypeManifest, manifest.payload, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("manifest %s of %s: %w", reference, repository, ErrNotFound)
+}
+
+func (s *DockerArchiveSource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	entry, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, ErrNotFound)
+	}
+	return readSeekNopCloser{s.section(entry)}, nil
+}
+
+/*
+ * DockerArchiveDestination writes images into a docker-archive that docker
+ * load reads. It holds a single platform of every image; blobs are stored
+ * as blobs/ALGORITHM/DIGEST entries. Close writes manifest.json and completes
+ * the archive.
+ */
+type DockerArchiveDestination struct {
+	// TempDir holds blobs while they are checked, before they are written
+	// into the archive. It defaults to the temporary directory of the OS.
+	TempDir string
+
+	writer   *tarWriter
+	written  map[digest.Digest]bool
+	images   []*dockerArchiveImage
+	byDigest map[digest.Digest]*dockerArchiveImage
+}
+
+func NewDockerArchiveDestination(archive io.Writer) *DockerArchiveDestination {
+	return &DockerArchiveDestination{
+		writer:   newTarWriter(archive),
+		written:  make(map[digest.Digest]bool),
+		byDigest: make(map[digest.Digest]*dockerArchiveImage),
+	}
+}
+
+func (d *DockerArchiveDestination) SinglePlatform() bool {
+	return true
+}
+
+func (d *DockerArchiveDestination) HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error) {
+	return d.written[desc.Digest], nil
+}
+
+func (d *DockerArchiveDestination) PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error {
+	if err := d.writer.writeBlob(c, dockerArchiveBlobPath(desc.Digest), d.TempDir, desc, content); err != nil {
+		return err
+	}
+	d.written[desc.Digest] = true
+	return nil
+}
+
+// PutManifest adds an image to manifest.json. Only image manifests, not
+// indexes, can be stored.
+func (d *DockerArchiveDestination) PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error {
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return err
+	}
+	var config distribution.Descriptor
+	var layers []distribution.Descriptor
+	switch typed := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		config, layers = typed.Config, typed.Layers
+	case *ocischema.DeserializedManifest:
+		config, layers = typed.Config, typed.Layers
+	default:
+		return errors.New("a docker-archive cannot hold a manifest of type " + mediaType)
+	}
+
+	manifestDigest := digest.FromBytes(payload)
+	image := d.byDigest[manifestDigest]
+	if image == nil {
+		image = &dockerArchiveImage{Config: dockerArchiveBlobPath(config.Digest)}
+		for _, layer := range layers {
+			image.Layers = append(image.Layers, dockerArchiveBlobPath(layer.Digest))
+		}
+		d.byDigest[manifestDigest] = image
+		d.images = append(d.images, image)
+	}
+	if _, err := digest.Parse(reference); err != nil {
+		name := repository + ":" + reference
+		for _, tag := range image.RepoTags {
+			if tag == name {
+				return nil
+			}
+		}
+		image.RepoTags = append(image.RepoTags, name)
+	}
+	return nil
+}
+
+// Close writes manifest.json and the end of the archive, but does not close
+// the underlying writer.
+func (d *DockerArchiveDestination) Close() error {
+	images := make([]*dockerArchiveImage, 0, len(d.images))
+	images = append(images, d.images...)
+	data, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	if err := d.writer.writeFile(dockerArchiveManifestFile, data); err != nil {
+		return err
+	}
+	return d.writer.Close()
+}
+
+func dockerArchiveBlobPath(d digest.Digest) string {
+	return "blobs/" + d.Algorithm().String() + "/" + d.Encoded()
+}
@@ -0,0 +1,65 @@
+package copier
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
+func TestDockerArchiveRoundTrip(t *testing.T) {
+	c := context.Background()
+	quiet := &Options{Observer: event.Func(func(*event.Event) {})}
+	src := newMemorySource()
+	plain := src.blob("plain layer")
+	compressed := src.blob("\x1f\x8b\x08 compressed layer")
+	first := src.image(t, "app", "amd64", []distribution.Descriptor{plain, compressed})
+	second := src.image(t, "app", "arm64", nil)
+	src.index(t, "app", []distribution.Descriptor{first, second}, "1.0")
+
+	var archive bytes.Buffer
+	destination := NewDockerArchiveDestination(&archive)
+	result, err := Copy(c, src, destination, &Options{Platform: "linux/arch0", Observer: quiet.Observer})
+	if err != nil || result.Failed() {
+		t.Fatalf("copy into the archive: %v %+v", err, result)
+	}
+	if err := destination.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewDockerArchiveSource(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := source.Images(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Image{{Repository: "app", Reference: "1.0"}}; !reflect.DeepEqual(images, want) {
+		t.Fatalf("images: got %v, want %v", images, want)
+	}
+	mediaType, payload, err := source.Manifest(c, "app", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := manifest.(*schema2.DeserializedManifest).Layers
+	if len(layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(layers))
+	}
+	for i, want := range []distribution.Descriptor{
+		{MediaType: schema2.MediaTypeUncompressedLayer, Digest: plain.Digest, Size: plain.Size},
+		{MediaType: schema2.MediaTypeLayer, Digest: compressed.Digest, Size: compressed.Size},
+	} {
+		if !reflect.DeepEqual(layers[i], want) {
+			t.Errorf("layer %d: got %+v, want %+v", i, layers[i], want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package copier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationImageName is the annotation containerd gives the index entries
+// of an OCI image layout, with the full name of their image.
+const AnnotationImageName = "io.containerd.image.name"
+
+const ociIndexFile = "index.json"
+
+/*
+ * OCILayoutSource reads images from an OCI image layout directory. The
+ * entries of its index.json are the images: their repository and tag come
+ * from the io.containerd.image.name annotation, or else their tag from the
+ * org.opencontainers.image.ref.name annotation and their repository from
+ * Repository.
+ */
+type OCILayoutSource struct {
+	Dir string
+	// Repository of the entries without an image name. It defaults to the
+	// name of the directory.
+	Repository string
+}
+
+func (s *OCILayoutSource) repository() string {
+	if len(s.Repository) > 0 {
+		return s.Repository
+	}
+	return filepath.Base(filepath.Clean(s.Dir))
+}
+
+// entries returns the images of index.json with their descriptors.
+func (s *OCILayoutSource) entries() ([]Image, []v1.Descriptor, error) {
+	index, err := readOCIIndex(s.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var images []Image
+	for _, desc := range index.Manifests {
+		image := Image{Repository: s.repository(), Reference: desc.Digest.String()}
+		if name := desc.Annotations[AnnotationImageName]; len(name) > 0 {
+			repository, tag := splitImageName(name)
+			image.Repository = repository
+			if len(tag) > 0 {
+				image.Reference = tag
+			}
+		} else if tag := desc.Annotations[v1.AnnotationRefName]; len(tag) > 0 {
+			image.Reference = tag
+		}
+		images = append(images, image)
+	}
+	return images, index.Manifests, nil
+}
+
+func (s *OCILayoutSource) Images(c context.Context) ([]Image, error) {
+	images, _, err := s.entries()
+	return images, err
+}
+
+func (s *OCILayoutSource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	d, err := digest.Parse(reference)
+	mediaType := ""
+	if err != nil {
+		images, descs, err := s.entries()
+		if err != nil {
+			return "", nil, err
+		}
+		for i, image := range images {
+			if image.Repository == repository && image.Reference == reference {
+				d = descs[i].Digest
+				mediaType = descs[i].MediaType
+			}
+		}
+		if len(d) == 0 {
+			return "", nil, fmt.Errorf("manifest %s of %s: %w", reference, repository, ErrNotFound)
+		}
+	}
+	payload, err := os.ReadFile(ociBlobPath(s.Dir, d))
+	if err != nil {
+		return "", nil, err
+	}
+	return mediaType, payload, nil
+}
+
+func (s *OCILayoutSource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	return os.Open(ociBlobPath(s.Dir, desc.Digest))
+}
+
+/*
+ * OCILayoutDestination writes images into an OCI image layout directory,
+ * adding to the layout already there. Every tag becomes an entry of
+ * index.json annotated with the tag, as org.opencontainers.image.ref.name,
+ * and with the repository and tag, as io.containerd.image.name.
+ */
+type OCILayoutDestination struct {
+	Dir string
+}
+
+// NewOCILayoutDestination creates the layout in dir unless it exists.
+func NewOCILayoutDestination(dir string) (*OCILayoutDestination, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		return nil, err
+	}
+	layout, err := json.Marshal(&v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, v1.ImageLayoutFile), layout, 0644); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ociIndexFile)); errors.Is(err, os.ErrNotExist) {
+		if err := writeOCIIndex(dir, &v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}}); err != nil {
+			return nil, err
+		}
+	}
+	return &OCILayoutDestination{Dir: dir}, nil
+}
+
+func (d *OCILayoutDestination) HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(ociBlobPath(d.Dir, desc.Digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *OCILayoutDestination) PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	return writeFileVerified(c, ociBlobPath(d.Dir, desc.Digest), desc.Digest, content)
+}
+
+func (d *OCILayoutDestination) PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error {
+	manifestDigest := digest.FromBytes(payload)
+	filename := ociBlobPath(d.Dir, manifestDigest)
+	if _, err := os.Stat(filename); err != nil {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, payload, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err := digest.Parse(reference); err == nil {
+		return nil
+	}
+
+	index, err := readOCIIndex(d.Dir)
+	if err != nil {
+		return err
+	}
+	name := repository + ":" + reference
+	manifests := index.Manifests[:0]
+	for _, desc := range index.Manifests {
+		if desc.Annotations[AnnotationImageName] != name {
+			manifests = append(manifests, desc)
+		}
+	}
+	index.Manifests = append(manifests, v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    manifestDigest,
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			v1.AnnotationRefName: reference,
+			AnnotationImageName:  name,
+		},
+	})
+	return writeOCIIndex(d.Dir, index)
+}
+
+func ociBlobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func readOCIIndex(dir string) (*v1.Index, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	index := &v1.Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("%s: %v", ociIndexFile, err)
+	}
+	return index, nil
+}
+
+// writeOCIIndex replaces index.json, atomically so that an interrupted copy
+// leaves the previous index.
+func writeOCIIndex(dir string, index *v1.Index) error {
+	index.MediaType = v1.MediaTypeImageIndex
+	if index.Manifests == nil {
+		index.Manifests = []v1.Descriptor{}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ociIndexFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, ociIndexFile))
+}
+
+// writeFileVerified writes content to filename through a temporary file, so
+// that filename only ever holds a blob matching d.
+func writeFileVerified(c context.Context, filename string, d digest.Digest, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := copyVerified(c, file, content, d); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// splitImageName splits repository:tag; the tag is empty when name has
+// none, or a digest instead.
+func splitImageName(name string) (string, string) {
+	if at := strings.Index(name, "@"); at >= 0 {
+		return name[:at], ""
+	}
+	index := strings.LastIndex(name, ":")
+	if index < 0 || strings.Contains(name[index:], "/") {
+		return name, ""
+	}
+	return name[:index], name[index+1:]
+}
@@ -0,0 +1,49 @@
+package copier
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestOCILayoutRoundTrip(t *testing.T) {
+	c := context.Background()
+	quiet := &Options{Observer: event.Func(func(*event.Event) {})}
+	src := newMemorySource()
+	layer := src.blob("layer")
+	image := src.image(t, "library/alpine", "image", []distribution.Descriptor{layer}, "3.18")
+
+	dir := t.TempDir()
+	layout, err := NewOCILayoutDestination(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := Copy(c, src, layout, quiet); err != nil || result.Failed() {
+		t.Fatalf("copy into the layout: %v %+v", err, result)
+	}
+
+	source := &OCILayoutSource{Dir: dir}
+	images, err := source.Images(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Image{{Repository: "library/alpine", Reference: "3.18"}}; !reflect.DeepEqual(images, want) {
+		t.Fatalf("images: got %v, want %v", images, want)
+	}
+
+	dst := newMemoryDestination(map[digest.Digest]string{image.Digest: "image"})
+	if result, err := Copy(c, source, dst, quiet); err != nil || result.Failed() {
+		t.Fatalf("copy from the layout: %v %+v", err, result)
+	}
+	if !dst.blobs["library/alpine@"+layer.Digest.String()] {
+		t.Error("layer not copied from the layout")
+	}
+	want := []string{"manifest library/alpine image", "manifest library/alpine 3.18"}
+	if got := dst.operations[len(dst.operations)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifests: got %q, want %q", got, want)
+	}
+}
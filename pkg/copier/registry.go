@@ -0,0 +1,127 @@
+package copier
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// RegistrySource reads images from a registry.
+type RegistrySource struct {
+	Registry *registry.Registry
+}
+
+// Images lists every tag of every repository of the registry catalog.
+func (s *RegistrySource) Images(c context.Context) ([]Image, error) {
+	repositories, err := s.Registry.Repositories(c)
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, repository := range repositories {
+		tags, err := s.Registry.Tags(c, repository)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			images = append(images, Image{Repository: repository, Reference: tag})
+		}
+	}
+	return images, nil
+}
+
+func (s *RegistrySource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	manifest, err := s.Registry.ManifestV2(c, repository, reference)
+	if err != nil {
+		return "", nil, err
+	}
+	return manifest.Payload()
+}
+
+func (s *RegistrySource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	return s.Registry.DownloadBlob(c, repository, desc.Digest)
+}
+
+/*
+ * RegistriesSource reads images from several registries. The first path
+ * segment of its repositories is the host name of their registry, as in
+ * docker.io/library/alpine.
+ */
+type RegistriesSource struct {
+	// Registry returns the client of a registry from its host name.
+	Registry func(c context.Context, name string) (*registry.Registry, error)
+}
+
+// Images fails, as registries cannot list the images of other registries.
+func (s *RegistriesSource) Images(c context.Context) ([]Image, error) {
+	return nil, errors.New("the images to copy from registries must be given")
+}
+
+func (s *RegistriesSource) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	source, err := s.source(c, &repository)
+	if err != nil {
+		return "", nil, err
+	}
+	return source.Manifest(c, repository, reference)
+}
+
+func (s *RegistriesSource) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	source, err := s.source(c, &repository)
+	if err != nil {
+		return nil, err
+	}
+	return source.Blob(c, repository, desc)
+}
+
+// source returns the source of the registry of repository, which it strips
+// of the registry name.
+func (s *RegistriesSource) source(c context.Context, repository *string) (*RegistrySource, error) {
+	tokens := strings.SplitN(*repository, "/", 2)
+	if len(tokens) != 2 {
+		return nil, errors.New("invalid repository (expected registry/repository): " + *repository)
+	}
+	reg, err := s.Registry(c, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	*repository = tokens[1]
+	return &RegistrySource{Registry: reg}, nil
+}
+
+// RegistryDestination stores images in a registry.
+type RegistryDestination struct {
+	Registry *registry.Registry
+}
+
+func (d *RegistryDestination) HasBlob(c context.Context, repository string, desc distribution.Descriptor) (bool, error) {
+	return d.Registry.HasBlob(c, repository, desc.Digest)
+}
+
+func (d *RegistryDestination) PutBlob(c context.Context, repository string, desc distribution.Descriptor, content io.Reader) error {
+	return d.Registry.UploadBlob(c, repository, desc.Digest, content, desc.Size)
+}
+
+func (d *RegistryDestination) MountBlob(c context.Context, repository, from string, dgst digest.Digest) error {
+	return d.Registry.MountBlob(c, repository, from, dgst)
+}
+
+func (d *RegistryDestination) PutManifest(c context.Context, repository, reference, mediaType string, payload []byte) error {
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return err
+	}
+	return d.Registry.PutManifest(c, repository, reference, manifest)
+}
+
+func (d *RegistryDestination) TagDigest(c context.Context, repository, tag string) (digest.Digest, error) {
+	existing, err := d.Registry.ManifestDigest(c, repository, tag)
+	if registry.IsNotFound(err) {
+		return "", nil
+	}
+	return existing, err
+}
@@ -0,0 +1,44 @@
+package copier
+
+import (
+	"errors"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/opencontainers/go-digest"
+)
+
+// TagPolicy decides what happens when a tag already exists in the
+// destination and points at a different manifest than the source's.
+type TagPolicy string
+
+const (
+	// TagPolicyOverwrite moves the tag to the source's manifest.
+	TagPolicyOverwrite TagPolicy = "overwrite"
+	// TagPolicySkip leaves the existing tag untouched.
+	TagPolicySkip TagPolicy = "skip"
+	// TagPolicyFail leaves the existing tag untouched and fails the copy.
+	TagPolicyFail TagPolicy = "fail"
+	// TagPolicyRename pushes the source's manifest under a tag suffixed
+	// with its digest instead.
+	TagPolicyRename TagPolicy = "rename"
+)
+
+func ParseTagPolicy(value string) (TagPolicy, error) {
+	switch policy := TagPolicy(value); policy {
+	case TagPolicyOverwrite, TagPolicySkip, TagPolicyFail, TagPolicyRename:
+		return policy, nil
+	case "":
+		return TagPolicyOverwrite, nil
+	}
+	return "", errors.New("invalid tag policy (expected overwrite, skip, fail or rename): " + value)
+}
+
+// renamedTag suffixes tag with the short form of d, keeping the result within
+// the 128 characters allowed for a tag.
+func renamedTag(tag string, d digest.Digest) string {
+	suffix := "-" + common.ShortDigest(d.String())
+	if len(tag)+len(suffix) > 128 {
+		tag = tag[:128-len(suffix)]
+	}
+	return tag + suffix
+}
@@ -0,0 +1,238 @@
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isComposeFile tells whether name is named as docker compose looks up its
+// files: compose.yaml, docker-compose.yml, docker-compose.override.yml...
+func isComposeFile(name string) bool {
+	base := strings.ToLower(filepath.Base(name))
+	ext := filepath.Ext(base)
+	if ext != ".yml" && ext != ".yaml" {
+		return false
+	}
+	stem := strings.TrimSuffix(base, ext)
+	return stem == "compose" || stem == "docker-compose" ||
+		strings.HasPrefix(stem, "compose.") || strings.HasPrefix(stem, "docker-compose.")
+}
+
+/*
+ * ScanCompose scans a compose file for the images of its services.
+ * Variables are interpolated as docker compose does, from Env or the process
+ * environment, then from the .env file beside the compose file. Services
+ * with a build section are built rather than pulled, so they are skipped.
+ */
+func (s *Scanner) ScanCompose(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(data, document); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	dotEnv, err := readEnvFile(filepath.Join(filepath.Dir(name), ".env"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.scanCompose(name, document, func(key string) (string, bool) {
+		if value, ok := s.lookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := dotEnv[key]
+		return value, ok
+	})
+}
+
+func (s *Scanner) scanCompose(name string, document *yaml.Node, env func(string) (string, bool)) error {
+	services := lookup(document, "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: no services", name)
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		service := services.Content[i].Value
+		image := lookup(services.Content[i+1], "image")
+		if image == nil || image.Kind != yaml.ScalarNode {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, image.Line)
+		if lookup(services.Content[i+1], "build") != nil {
+			s.notice("skipped image " + image.Value + " of " + source + ": service " + service + " is built")
+			continue
+		}
+		value, err := interpolate(image.Value, env)
+		if err != nil {
+			s.notice("skipped image " + image.Value + " of " + source + ": " + err.Error())
+			continue
+		}
+		s.add(source, value)
+	}
+	return nil
+}
+
+// isComposeDocument tells whether a YAML document is a compose file rather
+// than a Kubernetes object.
+func isComposeDocument(document *yaml.Node) bool {
+	services := lookup(document, "services")
+	return services != nil && services.Kind == yaml.MappingNode && lookup(document, "kind") == nil
+}
+
+func (s *Scanner) lookupEnv(key string) (string, bool) {
+	if s.Env != nil {
+		value, ok := s.Env[key]
+		return value, ok
+	}
+	return os.LookupEnv(key)
+}
+
+/*
+ * readEnvFile reads a .env file of KEY=VALUE lines. Blank lines and lines
+ * starting with # are ignored, as is an export keyword; values may be single
+ * or double quoted, and an unquoted value ends at " #".
+ */
+func readEnvFile(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		index := strings.Index(line, "=")
+		if index <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:index])
+		value := strings.TrimSpace(line[index+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && strings.IndexByte(value[1:], value[0]) > 0 {
+			value = value[1 : 1+strings.IndexByte(value[1:], value[0])]
+		} else if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+/*
+ * interpolate substitutes the variables of s as compose files and
+ * Dockerfiles do: $NAME, ${NAME}, ${NAME:-default}, ${NAME-default},
+ * ${NAME:+replacement}, ${NAME+replacement}, ${NAME:?error} and
+ * ${NAME?error}; $$ is a literal $. Unset variables are empty.
+ */
+func interpolate(s string, env func(string) (string, bool)) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				return "", errors.New("unterminated ${ in " + s)
+			}
+			value, err := expand(s[i+2:end], env)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i = end
+		case isNameByte(next, true):
+			end := i + 1
+			for end < len(s) && isNameByte(s[end], false) {
+				end++
+			}
+			value, _ := env(s[i+1 : end])
+			out.WriteString(value)
+			i = end - 1
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String(), nil
+}
+
+// expand returns the value of the content of a ${...} expression.
+func expand(expression string, env func(string) (string, bool)) (string, error) {
+	end := 0
+	for end < len(expression) && isNameByte(expression[end], end == 0) {
+		end++
+	}
+	name, operator := expression[:end], expression[end:]
+	if len(name) == 0 {
+		return "", errors.New("invalid variable ${" + expression + "}")
+	}
+	value, set := env(name)
+	if len(operator) == 0 {
+		return value, nil
+	}
+	colon := strings.HasPrefix(operator, ":")
+	operator = strings.TrimPrefix(operator, ":")
+	if len(operator) == 0 {
+		return "", errors.New("invalid variable ${" + expression + "}")
+	}
+	word := operator[1:]
+	// With a colon, an empty variable counts as unset.
+	present := set && (!colon || len(value) > 0)
+	switch operator[0] {
+	case '-':
+		if present {
+			return value, nil
+		}
+		return interpolate(word, env)
+	case '+':
+		if present {
+			return interpolate(word, env)
+		}
+		return "", nil
+	case '?':
+		if present {
+			return value, nil
+		}
+		if len(word) == 0 {
+			word = "required"
+		}
+		return "", errors.New(name + ": " + word)
+	}
+	return "", errors.New("invalid variable ${" + expression + "}")
+}
+
+// matchingBrace returns the index of the brace closing the one at open.
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
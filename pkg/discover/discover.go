@@ -0,0 +1,168 @@
+/*
+ * Package discover finds the images that deployment files reference, as
+ * registry/repository:tag or registry/repository@digest names that
+ * exporter.DoExport takes: Kubernetes manifests, Helm charts, compose files
+ * and Dockerfiles.
+ */
+package discover
+
+import (
+	_ "crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
+/*
+ * Scanner collects the images of the files it scans, once each, in the
+ * order they are found. References that cannot be parsed, such as template
+ * expressions, are skipped with a notice.
+ */
+type Scanner struct {
+	// Observer receives the notices of skipped references and files; when
+	// it is nil, they are logged.
+	Observer event.Observer
+	// Env holds the variables interpolated in compose files before those of
+	// their .env file; when it is nil, the process environment does.
+	Env map[string]string
+
+	images []string
+	seen   map[string]bool
+}
+
+// Images returns the images found so far.
+func (s *Scanner) Images() []string {
+	return append([]string(nil), s.images...)
+}
+
+/*
+ * Scan scans a file or a directory. A directory holding a Chart.yaml is a
+ * Helm chart, as is a .tgz file. Files named as compose files or
+ * Dockerfiles are scanned as such, as are YAML files holding services and
+ * no kind; other files are Kubernetes manifests. Directories are walked for
+ * those files and charts; the files that cannot be parsed there are skipped
+ * with a notice, while a file given to Scan must parse.
+ */
+func (s *Scanner) Scan(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.scanFile(path)
+	}
+	if isChartDir(path) {
+		return s.ScanChart(path)
+	}
+	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if name != path && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if name != path && isChartDir(name) {
+				if err := s.ScanChart(name); err != nil {
+					s.notice("skipped chart " + err.Error())
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if kind := fileKind(name); len(kind) > 0 {
+			if err := s.scanFile(name); err != nil {
+				s.notice("skipped " + kind + " " + err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// fileKind tells what a file found in a directory holds, or returns an
+// empty string for the files not scanned.
+func fileKind(name string) string {
+	if isComposeFile(name) {
+		return "compose file"
+	}
+	if isDockerfile(name) {
+		return "Dockerfile"
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "manifest"
+	case ".tgz":
+		return "chart"
+	}
+	return ""
+}
+
+func (s *Scanner) scanFile(name string) error {
+	switch {
+	case isChartArchive(name):
+		return s.ScanChart(name)
+	case isComposeFile(name):
+		return s.ScanCompose(name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if isDockerfile(name) {
+		return s.ScanDockerfile(name, file)
+	}
+	documents, err := decodeDocuments(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if len(documents) == 1 && isComposeDocument(documents[0]) {
+		return s.ScanCompose(name)
+	}
+	s.scanKubernetes(name, documents)
+	return nil
+}
+
+// add adds an image reference found in source, or skips it with a notice.
+func (s *Scanner) add(source, image string) {
+	image = strings.TrimSpace(image)
+	if len(image) == 0 {
+		return
+	}
+	name, err := Normalize(image)
+	if err != nil {
+		s.notice("skipped image " + image + " of " + source + ": " + err.Error())
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if !s.seen[name] {
+		s.seen[name] = true
+		s.images = append(s.images, name)
+	}
+}
+
+func (s *Scanner) notice(message string) {
+	event.Emit(s.Observer, &event.Event{Type: event.Notice, Message: message})
+}
+
+/*
+ * Normalize returns the name of an image reference as docker resolves it,
+ * as in docker.io/library/alpine:latest for alpine. A reference with both a
+ * tag and a digest is pulled by digest, so it is named by digest.
+ */
+func Normalize(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return named.Name() + "@" + digested.Digest().String(), nil
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
@@ -0,0 +1,182 @@
+package discover
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// isDockerfile tells whether name is named as a Dockerfile: Dockerfile,
+// Containerfile, Dockerfile.NAME or NAME.Dockerfile.
+func isDockerfile(name string) bool {
+	base := strings.ToLower(filepath.Base(name))
+	return base == "dockerfile" || base == "containerfile" ||
+		strings.HasPrefix(base, "dockerfile.") || strings.HasSuffix(base, ".dockerfile")
+}
+
+var (
+	directiveLine   = regexp.MustCompile(`^#\s*[A-Za-z][A-Za-z0-9]*\s*=`)
+	escapeDirective = regexp.MustCompile(`^#\s*escape\s*=\s*(\S)\s*$`)
+	heredocMarker   = regexp.MustCompile(`<<-?(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+)
+
+// instruction is a Dockerfile instruction, its continuation lines joined.
+type instruction struct {
+	line    int
+	keyword string
+	args    []string
+}
+
+/*
+ * ScanDockerfile scans a Dockerfile read from r, named name in notices, for
+ * the images its stages are built from: the FROM images that are not earlier
+ * stages or scratch, and the images of COPY --from and ADD --from. Variables
+ * are substituted with the defaults of the ARG instructions before the first
+ * FROM, as docker build does without --build-arg. The --platform of FROM is
+ * ignored, as every platform of an image is exported.
+ */
+func (s *Scanner) ScanDockerfile(name string, r io.Reader) error {
+	instructions, err := parseDockerfile(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	args := make(map[string]string)
+	env := func(key string) (string, bool) {
+		value, ok := args[key]
+		return value, ok
+	}
+	stages := make(map[string]bool)
+	stage := 0
+	for _, inst := range instructions {
+		source := fmt.Sprintf("%s:%d", name, inst.line)
+		switch inst.keyword {
+		case "ARG":
+			if stage > 0 {
+				continue
+			}
+			for _, arg := range inst.args {
+				key, value := arg, ""
+				if index := strings.Index(arg, "="); index >= 0 {
+					key = arg[:index]
+					value, err = interpolate(unquote(arg[index+1:]), env)
+					if err != nil {
+						s.notice("skipped ARG " + key + " of " + source + ": " + err.Error())
+						continue
+					}
+				}
+				if _, ok := args[key]; !ok || strings.Contains(arg, "=") {
+					args[key] = value
+				}
+			}
+		case "FROM":
+			var positional []string
+			for _, arg := range inst.args {
+				if !strings.HasPrefix(arg, "--") {
+					positional = append(positional, arg)
+				}
+			}
+			if len(positional) == 0 {
+				s.notice("skipped FROM of " + source + ": no image")
+				continue
+			}
+			s.addStageImage(source, positional[0], stages, env)
+			if len(positional) >= 3 && strings.EqualFold(positional[1], "AS") {
+				stages[strings.ToLower(positional[2])] = true
+			}
+			stage++
+		case "COPY", "ADD":
+			for _, arg := range inst.args {
+				if !strings.HasPrefix(arg, "--") {
+					break
+				}
+				if from := strings.TrimPrefix(arg, "--from="); from != arg {
+					if _, err := strconv.Atoi(from); err != nil {
+						s.addStageImage(source, from, stages, env)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addStageImage adds the image a stage is built from or copies from, unless
+// it is an earlier stage or scratch.
+func (s *Scanner) addStageImage(source, image string, stages map[string]bool, env func(string) (string, bool)) {
+	value, err := interpolate(image, env)
+	if err != nil {
+		s.notice("skipped image " + image + " of " + source + ": " + err.Error())
+		return
+	}
+	if stages[strings.ToLower(value)] || strings.EqualFold(value, "scratch") {
+		return
+	}
+	s.add(source, value)
+}
+
+// parseDockerfile splits a Dockerfile into instructions, handling the escape
+// directive, comments, line continuations and heredocs.
+func parseDockerfile(r io.Reader) ([]*instruction, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	escape := `\`
+	directives := true
+	var instructions []*instruction
+	var current strings.Builder
+	start := 0
+	heredoc := ""
+	for number := 1; scanner.Scan(); number++ {
+		trimmed := strings.TrimSpace(scanner.Text())
+		if len(heredoc) > 0 {
+			if trimmed == heredoc {
+				heredoc = ""
+			}
+			continue
+		}
+		if directives {
+			if match := escapeDirective.FindStringSubmatch(trimmed); match != nil {
+				escape = match[1]
+				continue
+			}
+			directives = directiveLine.MatchString(trimmed)
+		}
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			start = number
+		}
+		if strings.HasSuffix(trimmed, escape) {
+			current.WriteString(strings.TrimSuffix(trimmed, escape))
+			current.WriteByte(' ')
+			continue
+		}
+		current.WriteString(trimmed)
+		text := current.String()
+		current.Reset()
+
+		if fields := strings.Fields(text); len(fields) > 0 {
+			instructions = append(instructions, &instruction{line: start, keyword: strings.ToUpper(fields[0]), args: fields[1:]})
+		}
+		if match := heredocMarker.FindStringSubmatch(text); match != nil && match[1] == match[3] {
+			heredoc = match[2]
+		}
+	}
+	if fields := strings.Fields(current.String()); len(fields) > 0 {
+		instructions = append(instructions, &instruction{line: start, keyword: strings.ToUpper(fields[0]), args: fields[1:]})
+	}
+	return instructions, scanner.Err()
+}
+
+// unquote removes the quotes around an ARG default.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
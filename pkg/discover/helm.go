@@ -0,0 +1,267 @@
+package discover
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chart is the part of a Helm chart that names images.
+type chart struct {
+	source       string
+	name         string
+	appVersion   string
+	values       []byte
+	dependencies []*chart
+}
+
+/*
+ * ScanChart scans a Helm chart, a directory or a packaged .tgz, and the
+ * charts it depends on in its charts directory. Templates are not rendered;
+ * the images are those of the values, as charts conventionally declare
+ * them:
+ *
+ *	image: registry.example.com/app:1.0
+ *	image:
+ *	  registry: registry.example.com
+ *	  repository: app
+ *	  tag: "1.0"
+ *	  digest: sha256:...
+ *
+ * under an image key or a key ending with Image, such as initImage. Without
+ * a tag, the image is tagged with the appVersion of the chart, as templates
+ * usually default it.
+ */
+func (s *Scanner) ScanChart(name string) error {
+	var files map[string][]byte
+	var err error
+	if isChartArchive(name) {
+		var file *os.File
+		file, err = os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		files, err = readChartArchive(file)
+	} else {
+		files, err = readChartDir(name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	c, err := loadChart(name, files, "")
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return s.scanChart(c)
+}
+
+func (s *Scanner) scanChart(c *chart) error {
+	if len(c.values) > 0 {
+		values := &yaml.Node{}
+		if err := yaml.Unmarshal(c.values, values); err != nil {
+			return fmt.Errorf("%s: values.yaml: %v", c.source, err)
+		}
+		s.scanValues(c, "", values)
+	}
+	for _, dependency := range c.dependencies {
+		if err := s.scanChart(dependency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanValues adds the images of a values node found under key.
+func (s *Scanner) scanValues(c *chart, key string, node *yaml.Node) {
+	node = resolve(node)
+	if node == nil {
+		return
+	}
+	source := fmt.Sprintf("%s/values.yaml:%d", c.source, node.Line)
+	switch node.Kind {
+	case yaml.MappingNode:
+		if isImageKey(key) {
+			if image, ok := valuesImage(c, node); ok {
+				s.add(source, image)
+				return
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			s.scanValues(c, node.Content[i].Value, node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			s.scanValues(c, key, item)
+		}
+	case yaml.ScalarNode:
+		if isImageKey(key) && node.Tag == "!!str" && !strings.Contains(node.Value, "{{") {
+			s.add(source, node.Value)
+		}
+	}
+}
+
+func isImageKey(key string) bool {
+	return strings.EqualFold(key, "image") || strings.HasSuffix(key, "Image")
+}
+
+// valuesImage returns the image of a registry, repository, tag and digest
+// mapping; ok is false when it holds no repository.
+func valuesImage(c *chart, node *yaml.Node) (string, bool) {
+	repository := scalar(lookup(node, "repository"))
+	if len(repository) == 0 {
+		repository = scalar(lookup(node, "name"))
+	}
+	if len(repository) == 0 || strings.Contains(repository, "{{") {
+		return "", false
+	}
+	image := repository
+	if registry := scalar(lookup(node, "registry")); len(registry) > 0 {
+		image = strings.TrimSuffix(registry, "/") + "/" + repository
+	}
+	if digest := scalar(lookup(node, "digest")); len(digest) > 0 {
+		return image + "@" + digest, true
+	}
+	tag := scalar(lookup(node, "tag"))
+	if len(tag) == 0 {
+		tag = c.appVersion
+	}
+	if len(tag) > 0 {
+		image += ":" + tag
+	}
+	return image, true
+}
+
+// loadChart loads the chart at prefix of files, and its dependencies.
+func loadChart(source string, files map[string][]byte, prefix string) (*chart, error) {
+	metadata := struct {
+		Name       string `yaml:"name"`
+		AppVersion string `yaml:"appVersion"`
+	}{}
+	data, ok := files[prefix+"Chart.yaml"]
+	if !ok {
+		return nil, errors.New("no Chart.yaml")
+	}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("Chart.yaml: %v", err)
+	}
+	c := &chart{
+		source:     source,
+		name:       metadata.Name,
+		appVersion: metadata.AppVersion,
+		values:     files[prefix+"values.yaml"],
+	}
+
+	var names []string
+	for name := range files {
+		if strings.HasPrefix(name, prefix+"charts/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		relative := strings.TrimPrefix(name, prefix+"charts/")
+		tokens := strings.Split(relative, "/")
+		var dependency *chart
+		var err error
+		switch {
+		case len(tokens) == 1 && strings.HasSuffix(relative, ".tgz"):
+			var archive map[string][]byte
+			archive, err = readChartArchive(bytes.NewReader(files[name]))
+			if err == nil {
+				dependency, err = loadChart(source+"/charts/"+relative, archive, "")
+			}
+		case len(tokens) == 2 && tokens[1] == "Chart.yaml":
+			dependency, err = loadChart(source+"/charts/"+tokens[0], files, prefix+"charts/"+tokens[0]+"/")
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("charts/%s: %v", relative, err)
+		}
+		c.dependencies = append(c.dependencies, dependency)
+	}
+	return c, nil
+}
+
+// chartFile tells whether a file, relative to a chart, is read.
+func chartFile(name string) bool {
+	base := path.Base(name)
+	return base == "Chart.yaml" || base == "values.yaml" || (strings.HasSuffix(base, ".tgz") && strings.Contains(name, "charts/"))
+}
+
+// readChartDir reads the files of the chart directory dir that name images.
+func readChartDir(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if !chartFile(relative) {
+			return nil
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[relative] = data
+		return nil
+	})
+	return files, err
+}
+
+// readChartArchive reads the files of a packaged chart that name images,
+// relative to its top directory.
+func readChartArchive(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	files := make(map[string][]byte)
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		tokens := strings.SplitN(strings.TrimPrefix(header.Name, "./"), "/", 2)
+		if len(tokens) != 2 || !chartFile(tokens[1]) {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		files[tokens[1]] = data
+	}
+}
+
+func isChartDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "Chart.yaml"))
+	return err == nil && !info.IsDir()
+}
+
+func isChartArchive(name string) bool {
+	return strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar.gz")
+}
@@ -0,0 +1,170 @@
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// podSpecPaths are the paths to the pod spec of the workload kinds.
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"PodTemplate":           {"template", "spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// containerFields are the container lists of a pod spec.
+var containerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+
+// ScanKubernetes scans a stream of YAML or JSON Kubernetes objects read from
+// r, named name in notices, for the images of their containers.
+func (s *Scanner) ScanKubernetes(name string, r io.Reader) error {
+	documents, err := decodeDocuments(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	s.scanKubernetes(name, documents)
+	return nil
+}
+
+func (s *Scanner) scanKubernetes(name string, documents []*yaml.Node) {
+	for _, document := range documents {
+		for _, image := range ImageNodes(document) {
+			s.add(fmt.Sprintf("%s:%d", name, image.Line), image.Value)
+		}
+	}
+}
+
+// decodeDocuments decodes every document of a YAML stream.
+func decodeDocuments(r io.Reader) ([]*yaml.Node, error) {
+	decoder := yaml.NewDecoder(r)
+	var documents []*yaml.Node
+	for {
+		document := &yaml.Node{}
+		err := decoder.Decode(document)
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		} else if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+}
+
+/*
+ * ImageNodes returns the image scalars of the containers, init containers
+ * and ephemeral containers of the workloads of a YAML document, including
+ * the items of List kinds.
+ */
+func ImageNodes(document *yaml.Node) []*yaml.Node {
+	var images []*yaml.Node
+	object := resolve(document)
+	if object == nil || object.Kind != yaml.MappingNode {
+		return nil
+	}
+	kind := scalar(lookup(object, "kind"))
+	if strings.HasSuffix(kind, "List") {
+		if items := lookup(object, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				images = append(images, ImageNodes(item)...)
+			}
+		}
+		return images
+	}
+	path, ok := podSpecPaths[kind]
+	if !ok {
+		return nil
+	}
+	spec := lookup(object, path...)
+	if spec == nil {
+		return nil
+	}
+	for _, field := range containerFields {
+		containers := lookup(spec, field)
+		if containers == nil || containers.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, container := range containers.Content {
+			if image := lookup(container, "image"); image != nil && image.Kind == yaml.ScalarNode {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// resolve returns the content of a document node and the target of an
+// alias.
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil {
+		switch {
+		case node.Kind == yaml.DocumentNode && len(node.Content) > 0:
+			node = node.Content[0]
+		case node.Kind == yaml.AliasNode:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+	return nil
+}
+
+// lookup follows path through mappings, returning nil when a key is
+// missing.
+func lookup(node *yaml.Node, path ...string) *yaml.Node {
+	node = resolve(node)
+	for _, key := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		node = resolve(mappingValue(node, key))
+	}
+	return node
+}
+
+// mappingValue returns the value of key in a mapping, including the
+// mappings merged with <<.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		switch mapping.Content[i].Value {
+		case key:
+			return mapping.Content[i+1]
+		case "<<":
+			merged = append(merged, mapping.Content[i+1])
+		}
+	}
+	for _, node := range merged {
+		node = resolve(node)
+		sources := []*yaml.Node{node}
+		if node != nil && node.Kind == yaml.SequenceNode {
+			sources = node.Content
+		}
+		for _, source := range sources {
+			if source = resolve(source); source != nil && source.Kind == yaml.MappingNode {
+				if value := mappingValue(source, key); value != nil {
+					return value
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scalar returns the value of a scalar node, or an empty string.
+func scalar(node *yaml.Node) string {
+	node = resolve(node)
+	if node == nil || node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return ""
+	}
+	return node.Value
+}
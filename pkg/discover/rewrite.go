@@ -0,0 +1,99 @@
+package discover
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * RewriteImages rewrites the image references ImageNodes finds in a stream
+ * of Kubernetes objects. rewrite returns the new reference of an image found
+ * at a line, or false to keep it. Only the references are replaced, in
+ * place and in their quoting style, so that formatting and comments are
+ * preserved. It returns the new stream and the number of references
+ * rewritten.
+ */
+func RewriteImages(data []byte, rewrite func(line int, image string) (string, bool)) ([]byte, int, error) {
+	documents, err := decodeDocuments(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	lines := lineOffsets(data)
+
+	type replacement struct {
+		start, end int
+		value      string
+	}
+	var replacements []replacement
+	done := make(map[*yaml.Node]bool)
+	for _, document := range documents {
+		for _, node := range ImageNodes(document) {
+			if done[node] {
+				continue
+			}
+			done[node] = true
+			value, ok := rewrite(node.Line, node.Value)
+			if !ok || value == node.Value {
+				continue
+			}
+			start, end, err := scalarSpan(data, lines, node)
+			if err != nil {
+				return nil, 0, err
+			}
+			replacements = append(replacements, replacement{start, end, value})
+		}
+	}
+
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+	var out bytes.Buffer
+	previous := 0
+	for _, r := range replacements {
+		out.Write(data[previous:r.start])
+		out.WriteString(r.value)
+		previous = r.end
+	}
+	out.Write(data[previous:])
+	return out.Bytes(), len(replacements), nil
+}
+
+// lineOffsets returns the offset of every line of data.
+func lineOffsets(data []byte) []int {
+	offsets := []int{0}
+	for i, c := range data {
+		if c == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+// scalarSpan returns the offsets of the value of a plain, single quoted or
+// double quoted scalar, without its quotes, checking that it holds the value
+// parsed.
+func scalarSpan(data []byte, lines []int, node *yaml.Node) (int, int, error) {
+	if node.Line < 1 || node.Line > len(lines) {
+		return 0, 0, fmt.Errorf("line %d: invalid position", node.Line)
+	}
+	start := lines[node.Line-1]
+	for column := 1; column < node.Column && start < len(data); column++ {
+		_, size := utf8.DecodeRune(data[start:])
+		start += size
+	}
+	switch {
+	case node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0:
+		start++
+	case node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		return 0, 0, fmt.Errorf("line %d: image %s is a block scalar", node.Line, node.Value)
+	}
+	end := start + len(node.Value)
+	if end > len(data) || string(data[start:end]) != node.Value {
+		return 0, 0, fmt.Errorf("line %d: image %s is not written verbatim", node.Line, node.Value)
+	}
+	return start, end, nil
+}
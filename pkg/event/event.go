@@ -0,0 +1,195 @@
+package event
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Type tells what an Event reports.
+type Type string
+
+const (
+	// Request is a request of the registry client, with its Operation, URL,
+	// and the Repository, Digest or Reference it is about.
+	Request Type = "registry.request"
+
+	// ImageStarted and ImageDone or ImageFailed frame the export of the image
+	// Reference of Repository.
+	ImageStarted Type = "image.started"
+	ImageDone    Type = "image.done"
+	ImageFailed  Type = "image.failed"
+
+	// ManifestResolved reports a manifest read from a registry by the
+	// exporter, or from the archive by the importer.
+	ManifestResolved Type = "manifest.resolved"
+	ManifestPushed   Type = "manifest.pushed"
+	ManifestSkipped  Type = "manifest.skipped"
+	ManifestFailed   Type = "manifest.failed"
+	// TagConflict reports a tag of Destination that points at another
+	// manifest than the archive; Message tells how it was resolved.
+	TagConflict Type = "tag.conflict"
+
+	// BlobStarted, BlobProgress and BlobDone or BlobFailed follow a blob
+	// transfer. BlobSkipped reports a blob that needed no transfer, as it
+	// exists already or was transferred for another image.
+	BlobStarted  Type = "blob.started"
+	BlobProgress Type = "blob.progress"
+	BlobDone     Type = "blob.done"
+	BlobSkipped  Type = "blob.skipped"
+	BlobFailed   Type = "blob.failed"
+
+	// DestinationStarted and DestinationDone or DestinationFailed frame the
+	// import into Destination.
+	DestinationStarted Type = "destination.started"
+	DestinationDone    Type = "destination.done"
+	DestinationFailed  Type = "destination.failed"
+
+	// Notice is anything else worth telling, in Message.
+	Notice Type = "notice"
+)
+
+/*
+ * Event is something the exporter, the importer or the registry client did.
+ * Only the fields that apply to its Type are set.
+ */
+type Event struct {
+	Type Type
+	Time time.Time
+
+	// Destination is the name of the registry an import pushes to.
+	Destination string
+	Repository  string
+	// Reference is a tag or a digest.
+	Reference string
+	Digest    string
+	MediaType string
+	// Size is the size of the blob or manifest.
+	Size int64
+	// Bytes is the number of bytes transferred so far.
+	Bytes int64
+
+	// Operation and URL describe a registry request, such as
+	// "blob.upload". From is the source repository of a blob mount.
+	Operation string
+	URL       string
+	From      string
+
+	Message string
+	Err     error
+}
+
+/*
+ * Observer receives the events of an export or an import. Events are
+ * delivered synchronously, from the goroutine doing the work, so an observer
+ * should return quickly.
+ */
+type Observer interface {
+	Event(e *Event)
+}
+
+// Func adapts a function to an Observer.
+type Func func(e *Event)
+
+func (f Func) Event(e *Event) {
+	f(e)
+}
+
+type multi []Observer
+
+func (m multi) Event(e *Event) {
+	for _, o := range m {
+		o.Event(e)
+	}
+}
+
+// Multi returns an observer delivering every event to each of observers.
+func Multi(observers ...Observer) Observer {
+	return multi(observers)
+}
+
+// Emit sets the time of e and delivers it to o, or to Log when o is nil.
+func Emit(o Observer, e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if o == nil {
+		o = Log
+	}
+	o.Event(e)
+}
+
+// Log writes events with the standard logger, one line each, except the
+// frequent BlobProgress.
+var Log Observer = Func(func(e *Event) {
+	if e.Type != BlobProgress {
+		log.Print(e.String())
+	}
+})
+
+// Discard drops every event.
+var Discard Observer = Func(func(e *Event) {})
+
+func (e *Event) String() string {
+	switch e.Type {
+	case Request:
+		fields := []string{"registry." + e.Operation}
+		fields = appendField(fields, "url", e.URL)
+		fields = appendField(fields, "repository", e.Repository)
+		fields = appendField(fields, "from", e.From)
+		fields = appendField(fields, "reference", e.Reference)
+		fields = appendField(fields, "digest", e.Digest)
+		if e.Err != nil {
+			fields = append(fields, fmt.Sprintf("error=%q", e.Err.Error()))
+		}
+		return strings.Join(fields, " ")
+	case Notice:
+		return e.withError(e.Message)
+	}
+
+	var subject string
+	switch e.Type {
+	case BlobStarted, BlobProgress, BlobDone, BlobSkipped, BlobFailed:
+		subject = "BLOB: " + e.Digest + " (" + e.Repository + ")"
+	case DestinationStarted, DestinationDone, DestinationFailed:
+		subject = "DESTINATION: " + e.Destination
+	case TagConflict:
+		subject = "TAG CONFLICT: " + e.Repository + ":" + e.Reference
+	default:
+		subject = strings.ToUpper(strings.SplitN(string(e.Type), ".", 2)[0]) + ": " + e.Repository
+		if strings.Contains(e.Reference, ":") {
+			subject += "@" + e.Reference
+		} else if len(e.Reference) > 0 {
+			subject += ":" + e.Reference
+		}
+	}
+	if len(e.Destination) > 0 && !strings.HasPrefix(string(e.Type), "destination.") {
+		subject += " TO " + e.Destination
+	}
+	if e.Type == TagConflict {
+		return subject + " " + e.Message
+	}
+	line := subject + " " + strings.ToUpper(strings.SplitN(string(e.Type), ".", 2)[1])
+	if e.Type == BlobProgress {
+		line += fmt.Sprintf(" %d/%d", e.Bytes, e.Size)
+	}
+	if len(e.Message) > 0 {
+		line += " (" + e.Message + ")"
+	}
+	return e.withError(line)
+}
+
+func (e *Event) withError(line string) string {
+	if e.Err != nil {
+		return line + ": " + e.Err.Error()
+	}
+	return line
+}
+
+func appendField(fields []string, key string, value string) []string {
+	if len(value) == 0 {
+		return fields
+	}
+	return append(fields, key+"="+value)
+}
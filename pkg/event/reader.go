@@ -0,0 +1,68 @@
+package event
+
+import (
+	"io"
+	"time"
+)
+
+// progressInterval is the least time between two BlobProgress events of a
+// transfer.
+const progressInterval = time.Second
+
+type progressReader struct {
+	observer Observer
+	template Event
+	reader   io.Reader
+	bytes    int64
+	last     time.Time
+}
+
+/*
+ * Reader wraps the reader of a blob transfer so that o receives BlobProgress
+ * events like template, with the bytes read so far, at most once a second
+ * and when the blob has been read entirely. A reader that is an io.Seeker
+ * stays one, so that uploads can still be retried from the start.
+ */
+func Reader(o Observer, template Event, reader io.Reader) io.Reader {
+	if o == nil {
+		return reader
+	}
+	template.Type = BlobProgress
+	progress := &progressReader{
+		observer: o,
+		template: template,
+		reader:   reader,
+		last:     time.Now(),
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		return &progressSeeker{progressReader: progress, seeker: seeker}
+	}
+	return progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytes += int64(n)
+	now := time.Now()
+	if n > 0 && (now.Sub(r.last) >= progressInterval || r.bytes == r.template.Size) {
+		r.last = now
+		e := r.template
+		e.Time = now
+		e.Bytes = r.bytes
+		r.observer.Event(&e)
+	}
+	return n, err
+}
+
+type progressSeeker struct {
+	*progressReader
+	seeker io.Seeker
+}
+
+func (r *progressSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.seeker.Seek(offset, whence)
+	if err == nil {
+		r.bytes = position
+	}
+	return position, err
+}
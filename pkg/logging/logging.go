@@ -0,0 +1,242 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return levelNames[level]
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(value string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(value, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(value, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, errors.New("invalid log level (expected debug, info, warn or error): " + value)
+}
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+/*
+ * Logger writes leveled entries made of a message and key-value fields, as
+ * text lines or JSON objects. Credentials in messages and field values are
+ * redacted (see Redact). All methods are safe to call on a nil Logger, which
+ * logs nothing.
+ */
+type Logger struct {
+	level  Level
+	format string
+	// out is the destination of entries; nil means the output of the
+	// standard logger at the time of writing, so that log.SetOutput applies.
+	out io.Writer
+
+	mutex sync.Mutex
+}
+
+// New creates a logger writing entries of level and above to out, or to the
+// output of the standard logger when out is nil.
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return nil, errors.New("invalid log format (expected text or json): " + format)
+	}
+	return &Logger{
+		level:  level,
+		format: format,
+		out:    out,
+	}, nil
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(&Logger{level: LevelInfo, format: FormatText})
+}
+
+// Default returns the logger set by SetDefault, initially one writing info
+// entries as text to the standard logger.
+func Default() *Logger {
+	return defaultLogger.Load().(*Logger)
+}
+
+// SetDefault makes l the logger of the components not given one.
+func SetDefault(l *Logger) {
+	defaultLogger.Store(l)
+}
+
+// Enabled tells whether entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.Log(LevelDebug, msg, keyvals...)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.Log(LevelInfo, msg, keyvals...)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.Log(LevelWarn, msg, keyvals...)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.Log(LevelError, msg, keyvals...)
+}
+
+/*
+ * Write an entry of level with msg and the fields of keyvals, which
+ * alternate keys and values. Nil and empty values are left out.
+ */
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buffer bytes.Buffer
+	now := time.Now()
+	msg = Redact(msg)
+	if l.format == FormatJSON {
+		entry := newOrderedObject()
+		entry.set("time", now.Format(time.RFC3339Nano))
+		entry.set("level", level.String())
+		entry.set("msg", msg)
+		forEachField(keyvals, func(key string, value interface{}) {
+			entry.set(key, value)
+		})
+		buffer.Write(entry.marshal())
+	} else {
+		buffer.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buffer.WriteString(strings.ToUpper(level.String()))
+		buffer.WriteByte(' ')
+		buffer.WriteString(msg)
+		forEachField(keyvals, func(key string, value interface{}) {
+			buffer.WriteByte(' ')
+			buffer.WriteString(key)
+			buffer.WriteByte('=')
+			buffer.WriteString(textValue(value))
+		})
+	}
+	buffer.WriteByte('\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	out := l.out
+	if out == nil {
+		out = log.Writer()
+	}
+	_, _ = out.Write(buffer.Bytes())
+}
+
+// forEachField calls f with every key and redacted value of keyvals that is
+// set.
+func forEachField(keyvals []interface{}, f func(key string, value interface{})) {
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if i+1 >= len(keyvals) {
+			f("!BADKEY", key)
+			break
+		}
+		value := keyvals[i+1]
+		switch typed := value.(type) {
+		case nil:
+			continue
+		case string:
+			if len(typed) == 0 {
+				continue
+			}
+			value = redactField(key, typed)
+		case error:
+			value = redactField(key, typed.Error())
+		case fmt.Stringer:
+			value = redactField(key, typed.String())
+		case time.Duration:
+			value = typed.String()
+		}
+		f(key, value)
+	}
+}
+
+func textValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if len(s) == 0 || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// orderedObject is a JSON object that keeps the order of its keys.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: make(map[string]interface{})}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) marshal() []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(o.values[key]))
+		}
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes()
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
+type observer struct {
+	logger *Logger
+}
+
+/*
+ * Observer returns an event.Observer logging events to l: registry requests
+ * and transfer progress at debug level, failures at error level, tag
+ * conflicts and notices carrying an error at warn level, and the rest at info
+ * level. The message of an entry is the event type, or the message of a
+ * notice, and the fields are those of the event that are set.
+ */
+func Observer(l *Logger) event.Observer {
+	return &observer{logger: l}
+}
+
+func (o *observer) Event(e *event.Event) {
+	level := eventLevel(e)
+	if !o.logger.Enabled(level) {
+		return
+	}
+	msg := string(e.Type)
+	if e.Type == event.Request {
+		msg = "registry." + e.Operation
+	} else if e.Type == event.Notice {
+		msg = e.Message
+	}
+	o.logger.Log(level, msg, EventFields(e)...)
+}
+
+func eventLevel(e *event.Event) Level {
+	switch e.Type {
+	case event.Request, event.BlobProgress, event.BlobStarted, event.ManifestResolved:
+		return LevelDebug
+	case event.ImageFailed, event.ManifestFailed, event.BlobFailed, event.DestinationFailed:
+		return LevelError
+	case event.TagConflict:
+		return LevelWarn
+	case event.Notice:
+		if e.Err != nil {
+			return LevelWarn
+		}
+	}
+	return LevelInfo
+}
+
+// EventFields returns the fields of e that are set, as key-value pairs.
+func EventFields(e *event.Event) []interface{} {
+	var keyvals []interface{}
+	add := func(key string, value string) {
+		if len(value) > 0 {
+			keyvals = append(keyvals, key, value)
+		}
+	}
+	add("url", e.URL)
+	add("destination", e.Destination)
+	add("repository", e.Repository)
+	add("from", e.From)
+	add("reference", e.Reference)
+	add("digest", e.Digest)
+	add("mediaType", e.MediaType)
+	if e.Size > 0 {
+		keyvals = append(keyvals, "size", e.Size)
+	}
+	if e.Bytes > 0 {
+		keyvals = append(keyvals, "bytes", e.Bytes)
+	}
+	if e.Type != event.Notice {
+		add("note", e.Message)
+	}
+	if e.Err != nil {
+		keyvals = append(keyvals, "error", e.Err)
+	}
+	return keyvals
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the credentials removed from log entries.
+const redacted = "REDACTED"
+
+var (
+	regexpURL           = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+	regexpAuthorization = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// sensitiveKeys are the field names, and URL query parameters, whose values
+// are credentials.
+var sensitiveKeys = []string{
+	"password",
+	"secret",
+	"token",
+	"authorization",
+	"signature",
+	"credential",
+	"sig",
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if key == sensitive || strings.Contains(key, sensitive) && sensitive != "sig" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Redact removes credentials from s: the passwords of URLs, the values of
+ * query parameters such as token or X-Amz-Signature, and the credentials of
+ * Bearer and Basic authorization headers.
+ */
+func Redact(s string) string {
+	if strings.Contains(s, "://") {
+		s = regexpURL.ReplaceAllStringFunc(s, redactURL)
+	}
+	return regexpAuthorization.ReplaceAllString(s, "$1 "+redacted)
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+	}
+	if len(u.RawQuery) > 0 {
+		query := u.Query()
+		for key := range query {
+			if isSensitive(key) {
+				query.Set(key, redacted)
+				changed = true
+			}
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+		}
+	}
+	if !changed {
+		return raw
+	}
+	return u.String()
+}
+
+// redactField redacts the value of a field, entirely when the key names a
+// credential.
+func redactField(key string, value string) string {
+	if isSensitive(key) {
+		return redacted
+	}
+	return Redact(value)
+}
@@ -0,0 +1,246 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultRegistry is the registry of repositories without a registry name,
+// as docker names them.
+const DefaultRegistry = "docker.io"
+
+/*
+ * Proxy is a server.Backend forwarding to upstream registries and recording
+ * every manifest and blob pulled. The first path segment of a repository
+ * names its registry when it holds a dot or a colon or is localhost, as in
+ * registry.example.com/app; other repositories are on DefaultRegistry.
+ * Serve it with server.Server.Namespaces so that containerd mirrors name the
+ * registry with their ns parameter.
+ */
+type Proxy struct {
+	// Registry returns the client of an upstream registry from its host name.
+	Registry func(c context.Context, name string) (*registry.Registry, error)
+	// CacheDir keeps the blobs pulled, as the export cache does; it may be
+	// empty.
+	CacheDir string
+	// File receives the recording after every new manifest or blob; it may
+	// be empty.
+	File string
+	// Observer receives a notice for every manifest and blob recorded and
+	// for recordings that cannot be written; when it is nil, they are
+	// logged.
+	Observer event.Observer
+
+	once      sync.Once
+	source    copier.Source
+	cache     *copier.CachedSource
+	mutex     sync.Mutex
+	recording Recording
+	recorded  map[string]bool
+}
+
+// NewProxy returns a Proxy appending to recording, which may be nil.
+func NewProxy(recording *Recording) *Proxy {
+	p := &Proxy{}
+	if recording != nil {
+		p.recording = *recording
+	}
+	for _, image := range p.recording.Images {
+		p.add(image.Repository + ":" + image.Tag + "@" + image.Digest.String())
+	}
+	for _, manifest := range p.recording.Manifests {
+		p.add(manifest.Repository + "@" + manifest.Digest.String())
+	}
+	for _, blob := range p.recording.Blobs {
+		p.add(blob.Repository + "#" + blob.Digest.String())
+	}
+	return p
+}
+
+// Recording returns a copy of what was pulled so far.
+func (p *Proxy) Recording() *Recording {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return &Recording{
+		Images:    append([]Image(nil), p.recording.Images...),
+		Manifests: append([]Manifest(nil), p.recording.Manifests...),
+		Blobs:     append([]Blob(nil), p.recording.Blobs...),
+	}
+}
+
+// Upstream returns the registry/repository name of a repository pulled.
+func Upstream(repository string) string {
+	tokens := strings.SplitN(repository, "/", 2)
+	if len(tokens) == 2 && (strings.ContainsAny(tokens[0], ".:") || tokens[0] == "localhost") {
+		return repository
+	}
+	if len(tokens) == 1 {
+		repository = "library/" + repository
+	}
+	return DefaultRegistry + "/" + repository
+}
+
+func (p *Proxy) upstream() copier.Source {
+	p.once.Do(func() {
+		p.source = &copier.RegistriesSource{Registry: p.Registry}
+		if len(p.CacheDir) > 0 {
+			p.cache = &copier.CachedSource{Source: p.source, Dir: p.CacheDir, Observer: p.Observer}
+			p.source = p.cache
+		}
+	})
+	return p.source
+}
+
+// Images returns the images recorded so far.
+func (p *Proxy) Images(c context.Context) ([]copier.Image, error) {
+	return (&Source{Recording: p.Recording()}).Images(c)
+}
+
+func (p *Proxy) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	repository = Upstream(repository)
+	mediaType, payload, err := p.upstream().Manifest(c, repository, reference)
+	if err != nil {
+		return "", nil, err
+	}
+	d := digest.FromBytes(payload)
+	if expected, err := digest.Parse(reference); err == nil {
+		// Only a manifest that matches its digest may enter the recording,
+		// and the archives exported from it.
+		if d = expected.Algorithm().FromBytes(payload); d != expected {
+			return "", nil, fmt.Errorf("manifest %s@%s from upstream has digest %s", repository, expected, d)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	changed := false
+	if p.add(repository + "@" + d.String()) {
+		p.recording.Manifests = append(p.recording.Manifests, Manifest{Repository: repository, Digest: d, MediaType: mediaType, Payload: payload})
+		p.emit(&event.Event{Type: event.Notice, Repository: repository, Digest: d.String(), Message: "recorded manifest " + repository + "@" + d.String()})
+		changed = true
+	}
+	if _, err := digest.Parse(reference); err != nil {
+		if p.add(repository + ":" + reference + "@" + d.String()) {
+			p.recording.Images = append(p.recording.Images, Image{Repository: repository, Tag: reference, Digest: d})
+			p.emit(&event.Event{Type: event.Notice, Repository: repository, Reference: reference, Digest: d.String(), Message: "recorded image " + repository + ":" + reference})
+			changed = true
+		}
+	}
+	if changed {
+		p.save()
+	}
+	return mediaType, payload, nil
+}
+
+/*
+ * Blob opens a blob of the upstream registry and records it. With a CacheDir,
+ * the blob is cached before it is served from its file, so that the Server
+ * can answer Range requests.
+ */
+func (p *Proxy) Blob(c context.Context, repository string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	repository = Upstream(repository)
+	content, err := p.upstream().Blob(c, repository, desc)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := content.(io.Seeker); !ok && p.cache != nil {
+		if content, err = p.cacheBlob(repository, desc.Digest, content); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.add(repository + "#" + desc.Digest.String()) {
+		p.recording.Blobs = append(p.recording.Blobs, Blob{Repository: repository, Digest: desc.Digest})
+		p.emit(&event.Event{Type: event.Notice, Repository: repository, Digest: desc.Digest.String(), Message: "recorded blob " + repository + "@" + desc.Digest.String()})
+		p.save()
+	}
+	return content, nil
+}
+
+// cacheBlob reads content into the cache and opens the cached file.
+func (p *Proxy) cacheBlob(repository string, d digest.Digest, content io.ReadCloser) (io.ReadCloser, error) {
+	_, err := io.Copy(io.Discard, content)
+	if cerr := content.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p.cache.Path(d))
+	if err != nil {
+		return nil, fmt.Errorf("blob %s@%s from upstream was not cached: %w", repository, d, err)
+	}
+	return file, nil
+}
+
+// StatBlob returns the size of a blob from the cache or, when it is not
+// cached, from the upstream registry, without recording it.
+func (p *Proxy) StatBlob(c context.Context, repository string, d digest.Digest) (distribution.Descriptor, error) {
+	repository = Upstream(repository)
+	p.upstream()
+	if p.cache != nil {
+		if info, err := os.Stat(p.cache.Path(d)); err == nil {
+			return distribution.Descriptor{Digest: d, Size: info.Size()}, nil
+		}
+	}
+	tokens := strings.SplitN(repository, "/", 2)
+	reg, err := p.Registry(c, tokens[0])
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return reg.BlobMetadata(c, tokens[1], d)
+}
+
+// Repositories returns the repositories recorded so far.
+func (p *Proxy) Repositories(c context.Context) ([]string, error) {
+	return p.Recording().Repositories(), nil
+}
+
+// Tags lists the tags of repository in its upstream registry.
+func (p *Proxy) Tags(c context.Context, repository string) ([]string, error) {
+	tokens := strings.SplitN(Upstream(repository), "/", 2)
+	reg, err := p.Registry(c, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	return reg.Tags(c, tokens[1])
+}
+
+// add tells whether key is recorded for the first time; p.mutex must be
+// held.
+func (p *Proxy) add(key string) bool {
+	if p.recorded == nil {
+		p.recorded = make(map[string]bool)
+	}
+	if p.recorded[key] {
+		return false
+	}
+	p.recorded[key] = true
+	return true
+}
+
+// save writes the recording to File; p.mutex must be held.
+func (p *Proxy) save() {
+	if len(p.File) == 0 {
+		return
+	}
+	if err := p.recording.WriteFile(p.File); err != nil {
+		p.emit(&event.Event{Type: event.Notice, Err: err, Message: "cannot write the recording " + p.File + ": " + err.Error()})
+	}
+}
+
+func (p *Proxy) emit(e *event.Event) {
+	event.Emit(p.Observer, e)
+}
@@ -0,0 +1,165 @@
+package record
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/jc-lab/docker-registry-importer/pkg/server"
+	"github.com/opencontainers/go-digest"
+)
+
+// upstream is a registry serving the manifests and blobs of app, counting
+// the requests it answers.
+type upstream struct {
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+
+	mutex    sync.Mutex
+	requests map[string]int
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mutex.Lock()
+	u.requests[r.Method+" "+r.URL.Path]++
+	u.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/v2/":
+	case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+		if !strings.Contains(r.Header.Get("Accept"), manifestlist.MediaTypeManifestList) {
+			http.Error(w, "manifest lists are not accepted", http.StatusNotAcceptable)
+			return
+		}
+		payload, ok := u.manifests[strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", manifestlist.MediaTypeManifestList)
+		_, _ = w.Write(payload)
+	case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+		data, ok := u.blobs[digest.Digest(strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/"))]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (u *upstream) count(request string) int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.requests[request]
+}
+
+func newTestProxy(t *testing.T, u *upstream) *httptest.Server {
+	upstreamServer := httptest.NewServer(u)
+	t.Cleanup(upstreamServer.Close)
+	reg, err := registry.New(upstreamServer.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Observer = event.Func(func(*event.Event) {})
+
+	proxy := NewProxy(nil)
+	proxy.CacheDir = t.TempDir()
+	proxy.Observer = reg.Observer
+	proxy.Registry = func(c context.Context, name string) (*registry.Registry, error) {
+		return reg, nil
+	}
+	proxyServer := httptest.NewServer(&server.Server{Backend: proxy})
+	t.Cleanup(proxyServer.Close)
+	return proxyServer
+}
+
+func TestProxyManifest(t *testing.T) {
+	list := []byte(`{"schemaVersion":2,"mediaType":"` + manifestlist.MediaTypeManifestList + `","manifests":[]}`)
+	d := digest.FromBytes(list)
+	u := &upstream{
+		manifests: map[string][]byte{
+			"v1":                                list,
+			d.String():                          list,
+			"sha256:" + strings.Repeat("0", 64): list,
+		},
+		requests: make(map[string]int),
+	}
+	proxy := newTestProxy(t, u)
+
+	tests := []struct {
+		reference string
+		status    int
+	}{
+		{"v1", http.StatusOK},
+		{d.String(), http.StatusOK},
+		{"sha256:" + strings.Repeat("0", 64), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(proxy.URL + "/v2/upstream.test/app/manifests/" + test.reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.reference, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestProxyBlob(t *testing.T) {
+	data := []byte("layer")
+	d := digest.FromBytes(data)
+	u := &upstream{blobs: map[digest.Digest][]byte{d: data}, requests: make(map[string]int)}
+	proxy := newTestProxy(t, u)
+	url := proxy.URL + "/v2/upstream.test/app/blobs/" + d.String()
+
+	resp, err := http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(data)) {
+		t.Errorf("HEAD: got status %d and length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if n := u.count("GET /v2/app/blobs/" + d.String()); n != 0 {
+		t.Errorf("HEAD: the upstream served %d GET requests", n)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("Range", "bytes=1-3")
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "aye" {
+		t.Errorf("GET range: got status %d and %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != int64(len(data)) {
+		t.Errorf("HEAD of the cached blob: got length %d", resp.ContentLength)
+	}
+	if n := u.count("HEAD /v2/app/blobs/" + d.String()); n != 1 {
+		t.Errorf("the upstream served %d HEAD requests, want 1", n)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Package record records the images clients pull through a Proxy, so that
+ * exactly those images can be exported afterwards.
+ */
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image is a tag pulled by a client and the manifest it pointed at.
+type Image struct {
+	// Repository is registry/repository, as in docker.io/library/alpine.
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+// Manifest is a manifest pulled by a client, by tag or digest.
+type Manifest struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	MediaType  string        `json:"mediaType"`
+	Payload    []byte        `json:"payload"`
+}
+
+// Blob is a blob pulled by a client.
+type Blob struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+// Recording is what clients pulled through a Proxy, in the order they did.
+type Recording struct {
+	Images    []Image    `json:"images"`
+	Manifests []Manifest `json:"manifests"`
+	Blobs     []Blob     `json:"blobs"`
+}
+
+// ReadFile reads a recording written by WriteFile.
+func ReadFile(filename string) (*Recording, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	recording := &Recording{}
+	if err := json.Unmarshal(data, recording); err != nil {
+		return nil, err
+	}
+	return recording, nil
+}
+
+// WriteFile writes the recording to filename, replacing it at once so that
+// a reader never sees a partial recording.
+func (r *Recording) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+/*
+ * ImageNames returns the images to export, as registry/repository:tag or
+ * registry/repository@digest: the tags pulled, and the manifests pulled by
+ * digest that are neither tagged nor referenced by an index pulled.
+ */
+func (r *Recording) ImageNames() []string {
+	covered := make(map[string]bool)
+	var names []string
+	for _, image := range r.Images {
+		key := image.Repository + "@" + image.Digest.String()
+		covered[key] = true
+		name := image.Repository + ":" + image.Tag
+		if !covered[name] {
+			covered[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, manifest := range r.Manifests {
+		if manifest.MediaType != manifestlist.MediaTypeManifestList && manifest.MediaType != v1.MediaTypeImageIndex {
+			continue
+		}
+		index := &manifestlist.ManifestList{}
+		if err := json.Unmarshal(manifest.Payload, index); err != nil {
+			continue
+		}
+		for _, child := range index.Manifests {
+			covered[manifest.Repository+"@"+child.Digest.String()] = true
+		}
+	}
+	for _, manifest := range r.Manifests {
+		key := manifest.Repository + "@" + manifest.Digest.String()
+		if !covered[key] {
+			covered[key] = true
+			names = append(names, key)
+		}
+	}
+	return names
+}
+
+// Repositories returns the repositories pulled, sorted.
+func (r *Recording) Repositories() []string {
+	seen := make(map[string]bool)
+	var repositories []string
+	for _, manifest := range r.Manifests {
+		if !seen[manifest.Repository] {
+			seen[manifest.Repository] = true
+			repositories = append(repositories, manifest.Repository)
+		}
+	}
+	sort.Strings(repositories)
+	return repositories
+}
+
+// manifest returns the manifest reference, a tag or digest, pointed at in
+// repository, if it was pulled.
+func (r *Recording) manifest(repository, reference string) *Manifest {
+	d, err := digest.Parse(reference)
+	if err != nil {
+		d = ""
+		for i := len(r.Images) - 1; i >= 0; i-- {
+			if r.Images[i].Repository == repository && r.Images[i].Tag == reference {
+				d = r.Images[i].Digest
+				break
+			}
+		}
+		if len(d) == 0 {
+			return nil
+		}
+	}
+	for i := range r.Manifests {
+		if r.Manifests[i].Repository == repository && r.Manifests[i].Digest == d {
+			return &r.Manifests[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * Source reads the manifests of Recording, so that tags resolve to the
+ * manifests clients pulled even when they moved since, and everything else
+ * from the wrapped Source.
+ */
+type Source struct {
+	copier.Source
+	Recording *Recording
+}
+
+func (s *Source) Images(c context.Context) ([]copier.Image, error) {
+	var images []copier.Image
+	for _, name := range s.Recording.ImageNames() {
+		images = append(images, copier.ParseImage(name))
+	}
+	return images, nil
+}
+
+func (s *Source) Manifest(c context.Context, repository, reference string) (string, []byte, error) {
+	if manifest := s.Recording.manifest(repository, reference); manifest != nil {
+		return manifest.MediaType, manifest.Payload, nil
+	}
+	return s.Source.Manifest(c, repository, reference)
+}
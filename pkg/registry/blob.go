@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DownloadBlob streams a blob. Reading the body stops when ctx is done.
+func (registry *Registry) DownloadBlob(ctx context.Context, repository string, digest digest.Digest) (io.ReadCloser, error) {
+	url := registry.url("/v2/%s/blobs/%s", repository, digest)
+	registry.request(&event.Event{Operation: "blob.download", URL: url, Repository: repository, Digest: digest.String()})
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// uploadAttempts bounds the upload sessions UploadBlob opens for a blob.
+const uploadAttempts = 3
+
+/*
+ * UploadBlob uploads a blob in a single PUT. When the upload fails or ctx is
+ * cancelled, the upload session is cancelled on the registry.
+ *
+ * The PUT itself is not retried: after a failed attempt, the registry may
+ * have discarded the session or completed it. Seekable content is uploaded
+ * again in a new session instead, after a transient error.
+ */
+func (registry *Registry) UploadBlob(ctx context.Context, repository string, digest digest.Digest, content io.Reader, blobSize int64) error {
+	seeker, seekable := content.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err := registry.uploadBlob(ctx, repository, digest, content, blobSize)
+		if err == nil || !seekable || attempt >= uploadAttempts || ctx.Err() != nil || !isTransientError(err) {
+			return err
+		}
+		timer := time.NewTimer(time.Duration(attempt) * DefaultMinBackoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if _, serr := seeker.Seek(start, io.SeekStart); serr != nil {
+			return err
+		}
+	}
+}
+
+// uploadBlob uploads a blob in a new upload session.
+func (registry *Registry) uploadBlob(ctx context.Context, repository string, digest digest.Digest, content io.Reader, blobSize int64) error {
+	uploadURL, err := registry.initiateUpload(ctx, repository)
+	if err != nil {
+		return err
+	}
+	sessionURL := uploadURL.String()
+	q := uploadURL.Query()
+	q.Set("digest", digest.String())
+	uploadURL.RawQuery = q.Encode()
+
+	registry.request(&event.Event{Operation: "blob.upload", URL: uploadURL.String(), Repository: repository, Digest: digest.String()})
+
+	upload, err := http.NewRequestWithContext(withoutRetry(ctx), "PUT", uploadURL.String(), content)
+	if err != nil {
+		registry.cancelUpload(sessionURL)
+		return err
+	}
+	upload.ContentLength = blobSize
+	upload.Header.Set("Content-Type", "application/octet-stream")
+
+	// A seekable content can be rewound, which lets the upload be sent again
+	// after a 401 or a redirect.
+	if seeker, ok := content.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			upload.GetBody = func() (io.ReadCloser, error) {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				return io.NopCloser(content), nil
+			}
+		}
+	}
+
+	resp, err := registry.Client.Do(upload)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		registry.cancelUpload(sessionURL)
+	}
+	return err
+}
+
+// cancelUploadTimeout bounds the DELETE of an abandoned upload session, which
+// runs after the context of the upload may have been cancelled.
+const cancelUploadTimeout = 10 * time.Second
+
+// cancelUpload deletes an upload session so that the registry does not keep
+// it around. Failures are ignored: the registry expires sessions eventually.
+func (registry *Registry) cancelUpload(location string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelUploadTimeout)
+	defer cancel()
+
+	registry.request(&event.Event{Operation: "blob.cancel-upload", URL: location})
+	req, err := http.NewRequestWithContext(ctx, "DELETE", location, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := registry.Client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (registry *Registry) HasBlob(ctx context.Context, repository string, digest digest.Digest) (bool, error) {
+	checkURL := registry.url("/v2/%s/blobs/%s", repository, digest)
+	registry.request(&event.Event{Operation: "blob.check", URL: checkURL, Repository: repository, Digest: digest.String()})
+
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	resp, err := registry.head(ctx, checkURL)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil {
+		return resp.StatusCode == http.StatusOK, nil
+	}
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (registry *Registry) BlobMetadata(ctx context.Context, repository string, digest digest.Digest) (distribution.Descriptor, error) {
+	checkURL := registry.url("/v2/%s/blobs/%s", repository, digest)
+	registry.request(&event.Event{Operation: "blob.check", URL: checkURL, Repository: repository, Digest: digest.String()})
+
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	resp, err := registry.head(ctx, checkURL)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	return distribution.Descriptor{
+		Digest: digest,
+		Size:   resp.ContentLength,
+	}, nil
+}
+
+// MountBlob links a blob that already exists in the from repository into
+// repository without transferring its content.
+func (registry *Registry) MountBlob(ctx context.Context, repository, from string, digest digest.Digest) error {
+	q := url.Values{}
+	q.Set("mount", digest.String())
+	q.Set("from", from)
+	mountURL := registry.url("/v2/%s/blobs/uploads/?%s", repository, q.Encode())
+	registry.request(&event.Event{Operation: "blob.mount", URL: mountURL, Repository: repository, From: from, Digest: digest.String()})
+
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	resp, err := registry.post(ctx, mountURL)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+
+	// The registry started a regular upload session instead of mounting.
+	if location := resp.Header.Get("Location"); len(location) > 0 {
+		if strings.HasPrefix(location, "/") {
+			location = registry.url(location)
+		}
+		registry.cancelUpload(location)
+	}
+	return fmt.Errorf("registry: blob %s could not be mounted from %s (status=%d)", digest, from, resp.StatusCode)
+}
+
+func (registry *Registry) initiateUpload(ctx context.Context, repository string) (*url.URL, error) {
+	initiateURL := registry.url("/v2/%s/blobs/uploads/", repository)
+	registry.request(&event.Event{Operation: "blob.initiate-upload", URL: initiateURL, Repository: repository})
+
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	resp, err := registry.post(ctx, initiateURL)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	location := resp.Header.Get("Location")
+	var locationURL *url.URL = nil
+	if strings.HasPrefix(location, "/") {
+		locationURL, err = url.Parse(registry.url(location))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		locationURL, err = url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locationURL, err
+}
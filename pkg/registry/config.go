@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/common"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
+// DockerHubURL is the endpoint of docker.io.
+const DockerHubURL = "https://registry-1.docker.io"
+
+// ClientOptions apply to every registry built by NewFromConfig and
+// NewFromRepositoryConfig, as the command line gives them.
+type ClientOptions struct {
+	// Proxy is the proxy of the registries without a RepositoryConfig.Proxy.
+	Proxy string
+	// InsecureRegistries may be reached over plain HTTP and without TLS
+	// verification, as IsInsecureRegistry matches them.
+	InsecureRegistries []string
+	// Timeout is the Registry.Timeout of the clients.
+	Timeout time.Duration
+	// Observer is the Registry.Observer of the clients.
+	Observer event.Observer
+}
+
+/*
+ * NewFromConfig builds the client of the registry named name, such as
+ * docker.io or registry.example.com:5000, from its config.Repositories entry,
+ * whose endpoint replaces the name. config and options may be nil; the
+ * insecure registries of config are added to those of options.
+ */
+func NewFromConfig(ctx context.Context, name string, config *common.Config, options *ClientOptions) (*Registry, error) {
+	url := name
+	if name == "docker.io" {
+		url = DockerHubURL
+	}
+	repoConfig := &common.RepositoryConfig{}
+	if options == nil {
+		options = &ClientOptions{}
+	}
+	if config != nil {
+		if config.Repositories[name] != nil {
+			repoConfig = config.Repositories[name]
+		}
+		merged := *options
+		merged.InsecureRegistries = append(append([]string(nil), options.InsecureRegistries...), config.InsecureRegistries...)
+		options = &merged
+	}
+	if len(repoConfig.Endpoint) > 0 {
+		url = repoConfig.Endpoint
+	}
+	return NewFromRepositoryConfig(ctx, url, repoConfig, options)
+}
+
+/*
+ * NewFromRepositoryConfig builds the client of the registry at url,
+ * connecting through the proxy of repoConfig or options, and authenticating
+ * as repoConfig says. Without credentials, those of the Docker CLI
+ * configuration are used.
+ *
+ * A url without a scheme is probed over HTTPS, falling back to HTTP for
+ * insecure registries, which also skip TLS verification.
+ */
+func NewFromRepositoryConfig(ctx context.Context, url string, repoConfig *common.RepositoryConfig, options *ClientOptions) (*Registry, error) {
+	if options == nil {
+		options = &ClientOptions{}
+	}
+	url = strings.TrimSuffix(url, "/")
+	insecure := IsInsecureRegistry(Host(url), options.InsecureRegistries)
+
+	tlsOptions := &TLSOptions{
+		CACert:     repoConfig.CACert,
+		ClientCert: repoConfig.ClientCert,
+		ClientKey:  repoConfig.ClientKey,
+		MinVersion: repoConfig.MinTLSVersion,
+		Insecure:   repoConfig.Insecure || insecure,
+	}
+	tlsConfig, err := tlsOptions.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}
+
+	proxyAddress := repoConfig.Proxy
+	if len(proxyAddress) == 0 {
+		proxyAddress = options.Proxy
+	}
+	if err := SetProxy(transport, proxyAddress); err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(url, "://") {
+		url = ProbeURL(ctx, transport, url, insecure, nil)
+	}
+
+	credentials := Credentials{
+		Username:      repoConfig.Username,
+		Password:      repoConfig.Password,
+		IdentityToken: repoConfig.IdentityToken,
+	}
+	if credentials == (Credentials{}) {
+		dockerCredentials, err := DockerCredentials(url)
+		if err != nil {
+			return nil, err
+		}
+		credentials = dockerCredentials
+	}
+	credentials.PasswordGrant = repoConfig.PasswordGrant
+	return &Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: WrapTransportWithCredentials(transport, url, credentials),
+		},
+		Observer: options.Observer,
+		Timeout:  options.Timeout,
+	}, nil
+}
+
+// Host returns the host:port of a registry URL or address.
+func Host(url string) string {
+	if index := strings.Index(url, "://"); index >= 0 {
+		url = url[index+3:]
+	}
+	return strings.SplitN(url, "/", 2)[0]
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dockerHubServer is the key Docker stores Docker Hub credentials under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+/*
+ * DockerConfig is the part of the Docker CLI configuration, config.json,
+ * that holds registry credentials.
+ */
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type DockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+/*
+ * Read the Docker CLI configuration from $DOCKER_CONFIG/config.json, or
+ * ~/.docker/config.json. A missing file is an empty configuration.
+ */
+func LoadDockerConfig() (*DockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if len(dir) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &DockerConfig{}, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return ReadDockerConfig(filepath.Join(dir, "config.json"))
+}
+
+func ReadDockerConfig(filename string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	input, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(input, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return config, nil
+}
+
+var (
+	defaultDockerConfig     *DockerConfig
+	defaultDockerConfigErr  error
+	defaultDockerConfigOnce sync.Once
+)
+
+/*
+ * Look up the credentials of host in the default Docker CLI configuration,
+ * which is read once.
+ */
+func DockerCredentials(host string) (Credentials, error) {
+	defaultDockerConfigOnce.Do(func() {
+		defaultDockerConfig, defaultDockerConfigErr = LoadDockerConfig()
+	})
+	if defaultDockerConfigErr != nil {
+		return Credentials{}, defaultDockerConfigErr
+	}
+	return defaultDockerConfig.Credentials(host)
+}
+
+/*
+ * Return the credentials of host, which may also be a URL, as the Docker CLI
+ * would: from its credential helper in credHelpers, from its auths entry, or
+ * from the credsStore helper. Credentials that are not found are empty.
+ */
+func (c *DockerConfig) Credentials(host string) (Credentials, error) {
+	host = normalizeDockerHost(host)
+	server := host
+	if host == "docker.io" {
+		server = dockerHubServer
+	}
+
+	if helper := c.CredHelpers[host]; len(helper) > 0 {
+		return credentialHelper(helper, server)
+	}
+
+	for key, auth := range c.Auths {
+		if normalizeDockerHost(key) != host {
+			continue
+		}
+		credentials, err := auth.credentials()
+		if err != nil {
+			return Credentials{}, fmt.Errorf("docker config auth of %s: %v", key, err)
+		}
+		if credentials != (Credentials{}) {
+			return credentials, nil
+		}
+	}
+
+	if len(c.CredsStore) > 0 {
+		return credentialHelper(c.CredsStore, server)
+	}
+	return Credentials{}, nil
+}
+
+func (auth *DockerAuth) credentials() (Credentials, error) {
+	credentials := Credentials{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+	}
+	if len(auth.Auth) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return Credentials{}, err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return Credentials{}, errors.New("invalid auth (expected base64 of username:password)")
+		}
+		credentials.Username = parts[0]
+		credentials.Password = parts[1]
+	}
+	return credentials, nil
+}
+
+// normalizeDockerHost reduces a registry URL or host to the host name Docker
+// stores credentials under, folding the Docker Hub aliases into docker.io.
+func normalizeDockerHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
+
+// credentialHelperNotFound is the message credential helpers print when they
+// have no credentials for a server.
+const credentialHelperNotFound = "credentials not found in native keychain"
+
+type credentialHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// credentialHelper runs docker-credential-<helper> get for server. A
+// "<token>" username marks the secret as an identity token.
+func credentialHelper(helper string, server string) (Credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), credentialHelperNotFound) {
+			return Credentials{}, nil
+		}
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		return Credentials{}, fmt.Errorf("docker-credential-%s get %s: %v %s", helper, server, err, message)
+	}
+
+	var output credentialHelperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return Credentials{}, fmt.Errorf("docker-credential-%s get %s: %v", helper, server, err)
+	}
+	if output.Username == "<token>" {
+		return Credentials{IdentityToken: output.Secret}, nil
+	}
+	return Credentials{Username: output.Username, Password: output.Secret}, nil
+}
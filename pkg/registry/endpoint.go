@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+)
+
+// probeTimeout bounds each request of ProbeURL.
+const probeTimeout = 30 * time.Second
+
+/*
+ * Report whether the registry at host, a host name or host:port, may be
+ * reached without verified TLS, as dockerd decides for its
+ * insecure-registries: host is listed itself, with or without its port, or
+ * its address is in a listed CIDR. Loopback addresses, including localhost,
+ * are always insecure registries.
+ */
+func IsInsecureRegistry(host string, insecureRegistries []string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, entry := range insecureRegistries {
+		entry = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(entry, "https://"), "http://"), "/")
+		if entry == host || entry == hostname {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Return the URL of the registry at address, a host name with an optional
+ * port and no scheme. The registry is probed at /v2/ over HTTPS; any HTTP
+ * answer, including 401, settles it. Only when allowHTTP is set does a failed
+ * HTTPS probe fall back to plain HTTP. When neither answers, the HTTPS URL is
+ * returned so that the error surfaces on first use.
+ */
+func ProbeURL(ctx context.Context, transport http.RoundTripper, address string, allowHTTP bool, logger *logging.Logger) string {
+	if logger == nil {
+		logger = logging.Default()
+	}
+	address = strings.TrimSuffix(address, "/")
+	httpsURL := "https://" + address
+	err := probe(ctx, transport, httpsURL)
+	if err == nil || !allowHTTP {
+		logger.Debug("registry.probe", "url", httpsURL)
+		return httpsURL
+	}
+
+	httpURL := "http://" + address
+	if probe(ctx, transport, httpURL) == nil {
+		logger.Info("registry.probe", "url", httpURL, "httpsError", err)
+		return httpURL
+	}
+	logger.Debug("registry.probe", "url", httpsURL)
+	return httpsURL
+}
+
+func probe(ctx context.Context, transport http.RoundTripper, url string) error {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   probeTimeout,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
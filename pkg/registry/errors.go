@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * ErrorCode is an error code of the distribution specification. The codes
+ * are errors themselves, so that errors.Is(err, ErrBlobUnknown) tells whether
+ * a registry answered with that code.
+ */
+type ErrorCode string
+
+const (
+	ErrBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrDenied              ErrorCode = "DENIED"
+	ErrUnsupported         ErrorCode = "UNSUPPORTED"
+	ErrTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+)
+
+func (code ErrorCode) Error() string {
+	return strings.ToLower(strings.ReplaceAll(string(code), "_", " "))
+}
+
+/*
+ * ErrNotFound matches any 404 response and any *_UNKNOWN error code.
+ */
+var ErrNotFound = errors.New("not found")
+
+// statusCodes are the codes implied by a status when the response carries no
+// error body, as HEAD responses never do.
+var statusCodes = map[int]ErrorCode{
+	http.StatusUnauthorized:     ErrUnauthorized,
+	http.StatusForbidden:        ErrDenied,
+	http.StatusMethodNotAllowed: ErrUnsupported,
+	http.StatusTooManyRequests:  ErrTooManyRequests,
+}
+
+/*
+ * Error is one entry of the error envelope of a registry response:
+ *
+ *	{"errors": [{"code": "BLOB_UNKNOWN", "message": "...", "detail": ...}]}
+ */
+type Error struct {
+	Code    ErrorCode       `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+func (err *Error) Error() string {
+	message := err.Message
+	if len(message) == 0 {
+		message = err.Code.Error()
+	}
+	if len(err.Detail) > 0 && string(err.Detail) != "null" {
+		return fmt.Sprintf("%s: %s (%s)", string(err.Code), message, err.Detail)
+	}
+	return fmt.Sprintf("%s: %s", string(err.Code), message)
+}
+
+func (err *Error) Is(target error) bool {
+	if target == ErrNotFound {
+		return strings.HasSuffix(string(err.Code), "_UNKNOWN")
+	}
+	code, ok := target.(ErrorCode)
+	return ok && code == err.Code
+}
+
+type errorEnvelope struct {
+	Errors []*Error `json:"errors"`
+}
+
+// parseErrors returns the errors of a distribution error body, or nil when
+// body is not one.
+func parseErrors(body []byte) []*Error {
+	var envelope errorEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil
+	}
+	var errs []*Error
+	for _, err := range envelope.Errors {
+		if err != nil && len(err.Code) > 0 {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
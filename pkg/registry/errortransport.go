@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type HTTPStatusError struct {
+	Response *http.Response
+	// Copied from `Response.Body` to avoid problems with unclosed bodies later.
+	// Nobody calls `err.Response.Body.Close()`, ever.
+	Body []byte
+	// Errors are parsed from Body when it is a distribution error envelope.
+	Errors []*Error
+}
+
+// maxErrorBody limits how much of a body that is not an error envelope, such
+// as an HTML page of a proxy, is shown in the message.
+const maxErrorBody = 256
+
+func (err *HTTPStatusError) Error() string {
+	if len(err.Errors) > 0 {
+		messages := make([]string, 0, len(err.Errors))
+		for _, e := range err.Errors {
+			messages = append(messages, e.Error())
+		}
+		return fmt.Sprintf("registry: %s (status=%v)", strings.Join(messages, "; "), err.Response.StatusCode)
+	}
+	body := err.Body
+	if len(body) > maxErrorBody {
+		body = append(body[:maxErrorBody:maxErrorBody], "..."...)
+	}
+	return fmt.Sprintf("http: non-successful response (status=%v body=%q)", err.Response.StatusCode, body)
+}
+
+/*
+ * Is matches the ErrorCode of any error of the body or, without error body,
+ * the code implied by the status, as well as ErrNotFound.
+ */
+func (err *HTTPStatusError) Is(target error) bool {
+	if target == ErrNotFound && err.Response.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, e := range err.Errors {
+		if e.Is(target) {
+			return true
+		}
+	}
+	if len(err.Errors) == 0 {
+		if code, ok := statusCodes[err.Response.StatusCode]; ok && code == target {
+			return true
+		}
+	}
+	return false
+}
+
+// As sets a **Error target to the first error of the body.
+func (err *HTTPStatusError) As(target interface{}) bool {
+	if e, ok := target.(**Error); ok && len(err.Errors) > 0 {
+		*e = err.Errors[0]
+		return true
+	}
+	return false
+}
+
+var _ error = &HTTPStatusError{}
+
+// IsNotFound reports whether err is a 404 response of the registry, or an
+// error with an *_UNKNOWN code.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+type ErrorTransport struct {
+	Transport http.RoundTripper
+}
+
+func (t *ErrorTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(request)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("http: failed to read response body (status=%v, err=%q)", resp.StatusCode, err)
+		}
+
+		return nil, &HTTPStatusError{
+			Response: resp,
+			Body:     body,
+			Errors:   parseErrors(body),
+		}
+	}
+
+	return resp, err
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -14,8 +15,10 @@ var (
 // getPaginatedJSON accepts a string and a pointer, and returns the
 // next page URL while updating pointed-to variable with a parsed JSON
 // value. When there are no more pages it returns `ErrNoMorePages`.
-func (registry *Registry) getPaginatedJSON(url string, response interface{}) (string, error) {
-	resp, err := registry.Client.Get(url)
+func (registry *Registry) getPaginatedJSON(ctx context.Context, url string, response interface{}) (string, error) {
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	resp, err := registry.get(ctx, url)
 	if err != nil {
 		return "", err
 	}
@@ -32,7 +35,7 @@ func (registry *Registry) getPaginatedJSON(url string, response interface{}) (st
 // Matches an RFC 5988 (https://tools.ietf.org/html/rfc5988#section-5)
 // Link header. For example,
 //
-//    <http://registry.example.com/v2/_catalog?n=5&last=tag5>; type="application/json"; rel="next"
+//	<http://registry.example.com/v2/_catalog?n=5&last=tag5>; type="application/json"; rel="next"
 //
 // The URL is _supposed_ to be wrapped by angle brackets `< ... >`,
 // but e.g., quay.io does not include them. Similarly, params like
@@ -2,6 +2,7 @@ package registry
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/ocischema"
@@ -13,14 +14,17 @@ import (
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
 	digest "github.com/opencontainers/go-digest"
 )
 
-func (registry *Registry) Manifest(repository, reference string) (*schema1.SignedManifest, error) {
+func (registry *Registry) Manifest(ctx context.Context, repository, reference string) (*schema1.SignedManifest, error) {
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
-	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
+	registry.request(&event.Event{Operation: "manifest.get", URL: url, Repository: repository, Reference: reference})
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -46,16 +50,18 @@ func (registry *Registry) Manifest(repository, reference string) (*schema1.Signe
 	return signedManifest, nil
 }
 
-func (registry *Registry) ManifestV2(repository, reference string) (distribution.Manifest, error) {
+func (registry *Registry) ManifestV2(ctx context.Context, repository, reference string) (distribution.Manifest, error) {
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
-	registry.Logf("registry.manifest.get url=%s repository=%s reference=%s", url, repository, reference)
+	registry.request(&event.Event{Operation: "manifest.get", URL: url, Repository: repository, Reference: reference})
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Accept", schema2.MediaTypeManifest+", "+v1.MediaTypeImageIndex+", "+v1.MediaTypeImageManifest)
+	req.Header.Set("Accept", schema2.MediaTypeManifest+", "+manifestlist.MediaTypeManifestList+", "+v1.MediaTypeImageIndex+", "+v1.MediaTypeImageManifest)
 	resp, err := registry.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -97,11 +103,19 @@ func (registry *Registry) ManifestV2(repository, reference string) (distribution
 	return output, nil
 }
 
-func (registry *Registry) ManifestDigest(repository, reference string) (digest.Digest, error) {
+func (registry *Registry) ManifestDigest(ctx context.Context, repository, reference string) (digest.Digest, error) {
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
-	registry.Logf("registry.manifest.head url=%s repository=%s reference=%s", url, repository, reference)
+	registry.request(&event.Event{Operation: "manifest.head", URL: url, Repository: repository, Reference: reference})
 
-	resp, err := registry.Client.Head(url)
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", schema2.MediaTypeManifest+", "+manifestlist.MediaTypeManifestList+", "+v1.MediaTypeImageIndex+", "+v1.MediaTypeImageManifest)
+	resp, err := registry.Client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -111,11 +125,13 @@ func (registry *Registry) ManifestDigest(repository, reference string) (digest.D
 	return digest.Parse(resp.Header.Get("Docker-Content-Digest"))
 }
 
-func (registry *Registry) DeleteManifest(repository string, digest digest.Digest) error {
+func (registry *Registry) DeleteManifest(ctx context.Context, repository string, digest digest.Digest) error {
 	url := registry.url("/v2/%s/manifests/%s", repository, digest)
-	registry.Logf("registry.manifest.delete url=%s repository=%s reference=%s", url, repository, digest)
+	registry.request(&event.Event{Operation: "manifest.delete", URL: url, Repository: repository, Reference: digest.String()})
 
-	req, err := http.NewRequest("DELETE", url, nil)
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 	if err != nil {
 		return err
 	}
@@ -129,9 +145,9 @@ func (registry *Registry) DeleteManifest(repository string, digest digest.Digest
 	return nil
 }
 
-func (registry *Registry) PutManifest(repository, reference string, manifest distribution.Manifest) error {
+func (registry *Registry) PutManifest(ctx context.Context, repository, reference string, manifest distribution.Manifest) error {
 	url := registry.url("/v2/%s/manifests/%s", repository, reference)
-	registry.Logf("registry.manifest.put url=%s repository=%s reference=%s", url, repository, reference)
+	registry.request(&event.Event{Operation: "manifest.put", URL: url, Repository: repository, Reference: reference})
 
 	mediaType, payload, err := manifest.Payload()
 	if err != nil {
@@ -139,7 +155,9 @@ func (registry *Registry) PutManifest(repository, reference string, manifest dis
 	}
 
 	buffer := bytes.NewBuffer(payload)
-	req, err := http.NewRequest("PUT", url, buffer)
+	ctx, cancel := registry.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, buffer)
 	if err != nil {
 		return err
 	}
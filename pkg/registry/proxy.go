@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyDirect disables proxying, including the one of the environment.
+const ProxyDirect = "direct"
+
+/*
+ * Route the connections of transport through proxyAddress, which is one of:
+ *
+ *   - "", to follow HTTP_PROXY, HTTPS_PROXY and NO_PROXY;
+ *   - "direct", to connect without a proxy;
+ *   - an http:// or https:// URL of a proxy, used with CONNECT for HTTPS
+ *     registries;
+ *   - a socks5:// URL, or a bare host:port, of a SOCKS5 proxy.
+ *
+ * Credentials in the URL authenticate to the proxy, with Basic auth for HTTP
+ * proxies and username/password authentication for SOCKS5.
+ */
+func SetProxy(transport *http.Transport, proxyAddress string) error {
+	switch proxyAddress {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+		return nil
+	case ProxyDirect:
+		transport.Proxy = nil
+		return nil
+	}
+
+	if !strings.Contains(proxyAddress, "://") {
+		proxyAddress = "socks5://" + proxyAddress
+	}
+	proxyURL, err := url.Parse(proxyAddress)
+	if err != nil {
+		return err
+	}
+	if len(proxyURL.Host) == 0 {
+		return errors.New("invalid proxy (no host): " + redactURL(proxyURL))
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(proxyURL)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{
+				User:     proxyURL.User.Username(),
+				Password: password,
+			}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, proxy.Direct)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = nil
+		if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+			transport.DialContext = contextDialer.DialContext
+		} else {
+			transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.Dial(network, address)
+			}
+		}
+	default:
+		return errors.New("invalid proxy scheme (expected http, https or socks5): " + proxyURL.Scheme)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+)
+
+type Registry struct {
+	URL    string
+	Client *http.Client
+	// Logger receives the requests at debug level when there is no
+	// Observer. When it is nil, logging.Default() is used.
+	Logger *logging.Logger
+	// Observer receives an event.Request for every request.
+	Observer event.Observer
+	// Timeout bounds every request that does not stream a blob. Zero means
+	// no limit besides the context of the call.
+	Timeout time.Duration
+}
+
+/*
+ * Create a new Registry with the given URL and credentials, then Ping()s it
+ * before returning it to verify that the registry is available.
+ *
+ * You can, alternately, construct a Registry manually by populating the fields.
+ * This passes http.DefaultTransport to WrapTransport when creating the
+ * http.Client.
+ */
+func New(registryURL, username, password string) (*Registry, error) {
+	transport := http.DefaultTransport
+
+	return newFromTransport(registryURL, username, password, transport)
+}
+
+/*
+ * Create a new Registry, as with New, using an http.Transport that disables
+ * SSL certificate verification.
+ */
+func NewInsecure(registryURL, username, password string) (*Registry, error) {
+	tlsConfig, _ := (&TLSOptions{Insecure: true}).TLSConfig()
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+
+	return newFromTransport(registryURL, username, password, transport)
+}
+
+/*
+ * Given an existing http.RoundTripper such as http.DefaultTransport, build the
+ * transport stack necessary to authenticate to the Docker registry API. This
+ * adds in support for OAuth bearer tokens, cached per scope, and HTTP Basic
+ * auth, retries
+ * transient failures, and sets up error handling this library relies on.
+ */
+func WrapTransport(transport http.RoundTripper, url, username, password string) http.RoundTripper {
+	return WrapTransportWithCredentials(transport, url, Credentials{Username: username, Password: password})
+}
+
+/*
+ * Credentials authenticate to a registry. IdentityToken is an OAuth2 refresh
+ * token, such as the one "docker login" stores, used to obtain bearer tokens.
+ * PasswordGrant opts in to the OAuth2 password grant, as TokenTransport
+ * describes.
+ */
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	PasswordGrant bool
+}
+
+/*
+ * Build the transport stack, as with WrapTransport, authenticating with
+ * credentials.
+ */
+func WrapTransportWithCredentials(transport http.RoundTripper, url string, credentials Credentials) http.RoundTripper {
+	retryTransport := NewRetryTransport(transport)
+	tokenTransport := &TokenTransport{
+		Transport:     retryTransport,
+		Username:      credentials.Username,
+		Password:      credentials.Password,
+		IdentityToken: credentials.IdentityToken,
+		PasswordGrant: credentials.PasswordGrant,
+	}
+	basicAuthTransport := &BasicTransport{
+		Transport: tokenTransport,
+		URL:       url,
+		Username:  credentials.Username,
+		Password:  credentials.Password,
+	}
+	errorTransport := &ErrorTransport{
+		Transport: basicAuthTransport,
+	}
+	return errorTransport
+}
+
+func newFromTransport(registryURL, username, password string, transport http.RoundTripper) (*Registry, error) {
+	url := strings.TrimSuffix(registryURL, "/")
+	transport = WrapTransport(transport, url, username, password)
+	registry := &Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: transport,
+		},
+	}
+
+	if err := registry.Ping(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+func (r *Registry) url(pathTemplate string, args ...interface{}) string {
+	pathSuffix := fmt.Sprintf(pathTemplate, args...)
+	url := fmt.Sprintf("%s%s", r.URL, pathSuffix)
+	return url
+}
+
+// request reports a request to the Observer, or to the Logger when there is
+// none.
+func (r *Registry) request(e *event.Event) {
+	e.Type = event.Request
+	if r.Observer != nil {
+		event.Emit(r.Observer, e)
+		return
+	}
+	logger := r.Logger
+	if logger == nil {
+		logger = logging.Default()
+	}
+	logger.Debug("registry."+e.Operation, logging.EventFields(e)...)
+}
+
+// withTimeout bounds ctx by the Timeout of the registry.
+func (r *Registry) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout > 0 {
+		return context.WithTimeout(ctx, r.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (r *Registry) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.Client.Do(req)
+}
+
+func (r *Registry) head(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.Client.Do(req)
+}
+
+func (r *Registry) post(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return r.Client.Do(req)
+}
+
+func (r *Registry) Ping(ctx context.Context) error {
+	url := r.url("/v2/")
+	r.request(&event.Event{Operation: "ping", URL: url})
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	resp, err := r.get(ctx, url)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
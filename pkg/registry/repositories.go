@@ -1,17 +1,23 @@
 package registry
 
+import (
+	"context"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
 type repositoriesResponse struct {
 	Repositories []string `json:"repositories"`
 }
 
-func (registry *Registry) Repositories() ([]string, error) {
+func (registry *Registry) Repositories(ctx context.Context) ([]string, error) {
 	url := registry.url("/v2/_catalog")
 	repos := make([]string, 0, 10)
 	var err error //We create this here, otherwise url will be rescoped with :=
 	var response repositoriesResponse
 	for {
-		registry.Logf("registry.repositories url=%s", url)
-		url, err = registry.getPaginatedJSON(url, &response)
+		registry.request(&event.Event{Operation: "repositories", URL: url})
+		url, err = registry.getPaginatedJSON(ctx, url, &response)
 		switch err {
 		case ErrNoMorePages:
 			repos = append(repos, response.Repositories...)
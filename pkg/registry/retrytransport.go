@@ -0,0 +1,326 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+)
+
+const (
+	DefaultMaxRetries         = 5
+	DefaultMinBackoff         = 500 * time.Millisecond
+	DefaultMaxBackoff         = 30 * time.Second
+	DefaultRateLimitThreshold = 10
+)
+
+/*
+ * RetryTransport retries requests that failed with a transient error: a
+ * network error, 429 Too Many Requests, 502, 503 or 504. Retries are spaced
+ * by exponential backoff with full jitter unless the registry sends
+ * Retry-After.
+ *
+ * A request with a body is only retried when the body can be rewound through
+ * Request.GetBody. After a network error, only idempotent requests are
+ * retried, as the registry may have acted on the first one. The PUT of a blob
+ * upload is never retried here: UploadBlob opens a new upload session.
+ *
+ * It also follows the RateLimit-Remaining header Docker Hub sends on manifest
+ * responses: once the remaining pulls of the window drop to
+ * RateLimitThreshold, further manifest GETs to that host are spread over the
+ * rest of the window instead of running into 429.
+ */
+type RetryTransport struct {
+	Transport          http.RoundTripper
+	MaxRetries         int
+	MinBackoff         time.Duration
+	MaxBackoff         time.Duration
+	RateLimitThreshold int
+	// Logger receives the retries; when it is nil, logging.Default() does.
+	Logger *logging.Logger
+
+	mutex      sync.Mutex
+	rateLimits map[string]*rateLimit
+}
+
+type rateLimit struct {
+	remaining int
+	window    time.Duration
+	next      time.Time
+}
+
+func NewRetryTransport(transport http.RoundTripper) *RetryTransport {
+	return &RetryTransport{
+		Transport:          transport,
+		MaxRetries:         DefaultMaxRetries,
+		MinBackoff:         DefaultMinBackoff,
+		MaxBackoff:         DefaultMaxBackoff,
+		RateLimitThreshold: DefaultRateLimitThreshold,
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.throttle(req); err != nil {
+		return nil, err
+	}
+
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.Transport.RoundTrip(attemptReq)
+		t.observeRateLimit(req, resp)
+
+		if attempt >= t.MaxRetries || !isRetryable(req, resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt, resp)
+		if err != nil {
+			t.logger().Warn("registry.retry", "url", redactURL(req.URL), "attempt", attempt+1, "delay", delay, "error", err)
+		} else {
+			t.logger().Warn("registry.retry", "url", redactURL(req.URL), "attempt", attempt+1, "delay", delay, "status", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		attemptReq = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+// noRetryKey marks the context of requests RetryTransport must not send
+// again.
+type noRetryKey struct{}
+
+// withoutRetry returns a context whose requests RetryTransport sends once.
+func withoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Value(noRetryKey{}) != nil {
+		return false
+	}
+	if err != nil {
+		// Errors of the transport itself, such as a reset connection, unless
+		// retrying cannot help. The request may have reached the registry
+		// before the error, so only idempotent requests are sent again.
+		return isIdempotent(req) && !isPermanentError(err)
+	}
+	return isRetryableStatus(resp.StatusCode)
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isTransientError reports whether err, returned by a request through the
+// transports of this package, is worth another attempt: a retryable status
+// or a network error.
+func isTransientError(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.Response.StatusCode)
+	}
+	return !isPermanentError(err)
+}
+
+// isIdempotent reports whether sending req twice has the effect of sending
+// it once, as the PUT of a manifest does. A POST may open a new upload
+// session and a PATCH appends to one on every attempt.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isPermanentError reports whether err is a TLS or protocol mismatch that a
+// retry would run into again: a certificate that does not verify, which the
+// verification errors of crypto/tls wrap, a TLS alert of the server, such as
+// a missing client certificate, or a plain HTTP answer to an HTTPS request.
+func isPermanentError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var systemRoots x509.SystemRootsError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) || errors.As(err, &systemRoots) {
+		return true
+	}
+	var recordHeader tls.RecordHeaderError
+	if errors.As(err, &recordHeader) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// backoff returns the delay before the next attempt: the Retry-After of the
+// response if present, otherwise a random duration up to
+// MinBackoff * 2^attempt, capped at MaxBackoff.
+func (t *RetryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return delay
+		}
+	}
+	ceiling := t.MinBackoff << uint(attempt)
+	if ceiling <= 0 || ceiling > t.MaxBackoff {
+		ceiling = t.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + time.Millisecond
+}
+
+// parseRetryAfter parses a Retry-After header holding either seconds or an
+// HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// parseRateLimit parses a header such as "76;w=21600" into the count and the
+// window.
+func parseRateLimit(value string) (int, time.Duration, bool) {
+	parts := strings.Split(value, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "w=") {
+			if seconds, err := strconv.Atoi(part[2:]); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return count, window, true
+}
+
+func isRateLimited(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/")
+}
+
+func (t *RetryTransport) observeRateLimit(req *http.Request, resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	remaining, window, ok := parseRateLimit(resp.Header.Get("RateLimit-Remaining"))
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.rateLimits == nil {
+		t.rateLimits = make(map[string]*rateLimit)
+	}
+	limit := t.rateLimits[req.URL.Host]
+	if limit == nil {
+		limit = &rateLimit{}
+		t.rateLimits[req.URL.Host] = limit
+	}
+	limit.remaining = remaining
+	limit.window = window
+	if remaining <= t.RateLimitThreshold && window > 0 {
+		limit.next = time.Now().Add(window / time.Duration(remaining+1))
+	} else {
+		limit.next = time.Time{}
+	}
+}
+
+// throttle delays a rate limited request while the remaining pulls of its
+// host are low.
+func (t *RetryTransport) throttle(req *http.Request) error {
+	if !isRateLimited(req) {
+		return nil
+	}
+
+	t.mutex.Lock()
+	var delay time.Duration
+	remaining := 0
+	if limit := t.rateLimits[req.URL.Host]; limit != nil && !limit.next.IsZero() {
+		delay = time.Until(limit.next)
+		remaining = limit.remaining
+	}
+	t.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t.logger().Info("registry.ratelimit", "host", req.URL.Host, "remaining", remaining, "delay", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *RetryTransport) logger() *logging.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return logging.Default()
+}
+
+// redactURL strips credentials from a URL before it is logged.
+func redactURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = nil
+	return redacted.String()
+}
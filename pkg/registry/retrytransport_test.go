@@ -0,0 +1,250 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/opencontainers/go-digest"
+)
+
+// scriptedServer answers its requests in turn with the handlers of script,
+// then with 200, logging them as "METHOD PATH BODY".
+type scriptedServer struct {
+	*httptest.Server
+	script []http.HandlerFunc
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func newScriptedServer(t *testing.T, script ...http.HandlerFunc) *scriptedServer {
+	s := &scriptedServer{script: script}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mutex.Lock()
+	s.requests = append(s.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+	var handler http.HandlerFunc
+	if len(s.script) > 0 {
+		handler, s.script = s.script[0], s.script[1:]
+	}
+	s.mutex.Unlock()
+	if handler != nil {
+		handler(w, r)
+	}
+}
+
+func (s *scriptedServer) log() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// status answers with code and header, given as name and value pairs.
+func status(code int, header ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// disconnect closes the connection without an answer.
+func disconnect(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func newTestRetryTransport(t *testing.T) *RetryTransport {
+	logger, err := logging.New(io.Discard, logging.LevelError, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RetryTransport{
+		Transport: http.DefaultTransport,
+		// Without Retry-After, the backoff of an hour runs into the timeout
+		// of the test.
+		MaxRetries:         2,
+		MinBackoff:         time.Hour,
+		MaxBackoff:         time.Hour,
+		RateLimitThreshold: DefaultRateLimitThreshold,
+		Logger:             logger,
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []http.HandlerFunc
+		method string
+		// body is sent with GetBody, unless it is not rewindable.
+		body       string
+		rewindable bool
+		// minBackoff replaces the backoff of an hour when it is not zero.
+		minBackoff time.Duration
+		status     int
+		want       []string
+	}{
+		{
+			name:   "Retry-After spaces the retries",
+			script: []http.HandlerFunc{status(http.StatusServiceUnavailable, "Retry-After", "0"), status(http.StatusTooManyRequests, "Retry-After", "0")},
+			method: http.MethodGet,
+			status: http.StatusOK,
+			want:   []string{"GET /v2/a/manifests/v1", "GET /v2/a/manifests/v1", "GET /v2/a/manifests/v1"},
+		},
+		{
+			name:   "retries stop at MaxRetries",
+			script: []http.HandlerFunc{status(http.StatusBadGateway, "Retry-After", "0"), status(http.StatusBadGateway, "Retry-After", "0"), status(http.StatusBadGateway, "Retry-After", "0")},
+			method: http.MethodGet,
+			status: http.StatusBadGateway,
+			want:   []string{"GET /v2/a/manifests/v1", "GET /v2/a/manifests/v1", "GET /v2/a/manifests/v1"},
+		},
+		{
+			name:   "client errors are not retried",
+			script: []http.HandlerFunc{status(http.StatusBadRequest, "Retry-After", "0")},
+			method: http.MethodGet,
+			status: http.StatusBadRequest,
+			want:   []string{"GET /v2/a/manifests/v1"},
+		},
+		{
+			name:       "body is rewound through GetBody",
+			script:     []http.HandlerFunc{status(http.StatusServiceUnavailable, "Retry-After", "0")},
+			method:     http.MethodPut,
+			body:       "{}",
+			rewindable: true,
+			status:     http.StatusOK,
+			want:       []string{"PUT /v2/a/manifests/v1 {}", "PUT /v2/a/manifests/v1 {}"},
+		},
+		{
+			name:   "body without GetBody is not sent again",
+			script: []http.HandlerFunc{status(http.StatusServiceUnavailable, "Retry-After", "0")},
+			method: http.MethodPut,
+			body:   "{}",
+			status: http.StatusServiceUnavailable,
+			want:   []string{"PUT /v2/a/manifests/v1 {}"},
+		},
+		{
+			name:       "idempotent request is retried after a network error",
+			script:     []http.HandlerFunc{disconnect},
+			method:     http.MethodGet,
+			minBackoff: time.Millisecond,
+			status:     http.StatusOK,
+			want:       []string{"GET /v2/a/manifests/v1", "GET /v2/a/manifests/v1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newScriptedServer(t, test.script...)
+			transport := newTestRetryTransport(t)
+			if test.minBackoff > 0 {
+				transport.MinBackoff = test.minBackoff
+			}
+			client := &http.Client{Transport: transport}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var body io.Reader
+			if test.rewindable {
+				body = bytes.NewReader([]byte(test.body))
+			} else if len(test.body) > 0 {
+				body = io.NopCloser(strings.NewReader(test.body))
+			}
+			req, err := http.NewRequestWithContext(ctx, test.method, s.URL+"/v2/a/manifests/v1", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, test.status)
+			}
+			if got := s.log(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("requests:\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryTransportNetworkErrorPost(t *testing.T) {
+	s := newScriptedServer(t, disconnect)
+	client := &http.Client{Transport: newTestRetryTransport(t)}
+	if resp, err := client.Post(s.URL+"/v2/a/blobs/uploads/", "", nil); err == nil {
+		resp.Body.Close()
+		t.Fatal("POST succeeded")
+	}
+	if got := s.log(); len(got) != 1 {
+		t.Errorf("POST sent %d times", len(got))
+	}
+}
+
+func TestRetryTransportRateLimit(t *testing.T) {
+	s := newScriptedServer(t, status(http.StatusOK, "RateLimit-Remaining", "1;w=1"))
+	client := &http.Client{Transport: newTestRetryTransport(t)}
+
+	get(t, client, s.URL+"/v2/a/manifests/v1")
+	// Blobs do not count against the limit.
+	start := time.Now()
+	get(t, client, s.URL+"/v2/a/blobs/sha256:0")
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("blob GET delayed by %v", elapsed)
+	}
+	// One pull left in a 1s window: the next one waits for half of it.
+	get(t, client, s.URL+"/v2/a/manifests/v1")
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("manifest GET delayed by %v only", elapsed)
+	}
+}
+
+func TestUploadBlobRestarts(t *testing.T) {
+	location := func(session string) http.HandlerFunc {
+		return status(http.StatusAccepted, "Location", "/v2/a/blobs/uploads/"+session)
+	}
+	s := newScriptedServer(t,
+		location("1"),
+		disconnect,
+		status(http.StatusNoContent),
+		location("2"),
+		status(http.StatusCreated),
+	)
+	registry := &Registry{
+		URL:      s.URL,
+		Client:   &http.Client{Transport: WrapTransport(http.DefaultTransport, s.URL, "", "")},
+		Observer: event.Func(func(*event.Event) {}),
+	}
+
+	content := "layer"
+	if err := registry.UploadBlob(context.Background(), "a", digest.FromString(content), strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST /v2/a/blobs/uploads/",
+		"PUT /v2/a/blobs/uploads/1 layer",
+		"DELETE /v2/a/blobs/uploads/1",
+		"POST /v2/a/blobs/uploads/",
+		"PUT /v2/a/blobs/uploads/2 layer",
+	}
+	if got := s.log(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests:\n got %q\nwant %q", got, want)
+	}
+}
@@ -1,16 +1,22 @@
 package registry
 
+import (
+	"context"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/event"
+)
+
 type tagsResponse struct {
 	Tags []string `json:"tags"`
 }
 
-func (registry *Registry) Tags(repository string) (tags []string, err error) {
+func (registry *Registry) Tags(ctx context.Context, repository string) (tags []string, err error) {
 	url := registry.url("/v2/%s/tags/list", repository)
 
 	var response tagsResponse
 	for {
-		registry.Logf("registry.tags url=%s repository=%s", url, repository)
-		url, err = registry.getPaginatedJSON(url, &response)
+		registry.request(&event.Event{Operation: "tags", URL: url, Repository: repository})
+		url, err = registry.getPaginatedJSON(ctx, url, &response)
 		switch err {
 		case ErrNoMorePages:
 			tags = append(tags, response.Tags...)
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+ * TLSOptions configure the TLS connections to a registry: a CA bundle trusted
+ * in addition to the system roots, a client certificate for mutual TLS, the
+ * minimum protocol version ("1.0" to "1.3") and whether certificate
+ * verification is skipped.
+ */
+type TLSOptions struct {
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	MinVersion string
+	Insecure   bool
+}
+
+/*
+ * Build the tls.Config described by the options. It returns nil when the
+ * options are all defaults.
+ */
+func (o *TLSOptions) TLSConfig() (*tls.Config, error) {
+	if o == nil || *o == (TLSOptions{}) {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: o.Insecure, //nolint:gosec
+	}
+
+	if len(o.MinVersion) > 0 {
+		version, err := ParseTLSVersion(o.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		config.MinVersion = version
+	}
+
+	if len(o.CACert) > 0 {
+		pem, err := os.ReadFile(o.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA bundle " + o.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(o.ClientCert) > 0 || len(o.ClientKey) > 0 {
+		if len(o.ClientCert) == 0 || len(o.ClientKey) == 0 {
+			return nil, errors.New("a client certificate requires both the certificate and the key")
+		}
+		certificate, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version (expected 1.0, 1.1, 1.2 or 1.3): %s", version)
+}
@@ -0,0 +1,570 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+)
+
+const (
+	// DefaultTokenExpiry is the lifetime of a token whose response carries no
+	// expires_in, as the token authentication specification prescribes.
+	DefaultTokenExpiry = 60 * time.Second
+	// tokenExpiryMargin renews a token a little before it expires so that a
+	// request does not reach the registry with a token that just lapsed.
+	tokenExpiryMargin = 10 * time.Second
+)
+
+/*
+ * TokenTransport authenticates requests with bearer tokens.
+ *
+ * Tokens are cached per realm, service and scope. Once a registry host has
+ * answered with a bearer challenge, later requests carry a token that covers
+ * their scope up front, cached or obtained before they are sent, instead of
+ * waiting for another 401. A token is renewed when it expires or when the
+ * registry rejects it.
+ *
+ * The scopes of a request are derived from its URL: pull for reads, pull and
+ * push for writes, plus pull on the source repository of a blob mount. They
+ * are requested together in one token.
+ *
+ * Tokens are obtained as the Docker token authentication specification
+ * describes, through the OAuth2 POST flow with a refresh or identity token,
+ * or through the GET flow with HTTP Basic auth; the OAuth2 password grant is
+ * only used with PasswordGrant.
+ */
+type TokenTransport struct {
+	Transport http.RoundTripper
+	Username  string
+	Password  string
+	// IdentityToken is a refresh token, as issued by "docker login", used
+	// instead of the password where the token server supports OAuth2.
+	IdentityToken string
+	// PasswordGrant sends the username and password through the OAuth2
+	// password grant before the GET flow, for token servers that require
+	// it. As with docker, it is off by default: most token servers do not
+	// speak OAuth2, and the password is only sent where it is asked for.
+	PasswordGrant bool
+	// Logger receives the tokens obtained; when it is nil, logging.Default()
+	// does.
+	Logger *logging.Logger
+
+	mutex           sync.Mutex
+	challenges      map[string]*authService
+	tokens          []*cachedToken
+	refreshTokens   map[string]string
+	noPasswordGrant map[string]bool
+}
+
+type cachedToken struct {
+	realm   string
+	service string
+	scopes  scopeSet
+	token   string
+	expires time.Time
+}
+
+func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scopes := requestScopes(req)
+
+	var token *cachedToken
+	if authService := t.challenge(req.URL.Host); authService != nil {
+		// The host demands tokens: obtain one for the scopes of req before
+		// sending it rather than after a 401, which a request whose body
+		// cannot be sent again would not survive.
+		if token = t.cachedToken(authService, scopes); token == nil {
+			var authResp *http.Response
+			var err error
+			if token, authResp, err = t.auth(req.Context(), authService, scopes); err != nil || token == nil {
+				return authResp, err
+			}
+		}
+	}
+	resp, err := t.Transport.RoundTrip(withToken(req, token))
+	if err != nil {
+		return resp, err
+	}
+
+	authService := isTokenDemand(resp)
+	if authService == nil {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body is consumed and cannot be sent again.
+		return resp, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.setChallenge(req.URL.Host, authService)
+	if token != nil {
+		t.invalidate(token)
+	}
+	return t.authAndRetry(authService, req, scopes.merge(authService.Scopes))
+}
+
+type authToken struct {
+	Token        string    `json:"token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	IssuedAt     time.Time `json:"issued_at"`
+}
+
+func (t *TokenTransport) authAndRetry(authService *authService, req *http.Request, scopes scopeSet) (*http.Response, error) {
+	token, authResp, err := t.auth(req.Context(), authService, scopes)
+	if err != nil || token == nil {
+		return authResp, err
+	}
+
+	retryResp, err := t.retry(req, token)
+	return retryResp, err
+}
+
+// Ways of obtaining a token, in the order they are tried.
+const (
+	grantRefreshToken = "refresh_token"
+	grantPassword     = "password"
+	grantBasic        = "basic"
+)
+
+/*
+ * auth obtains a token for scopes from the realm of authService. It exchanges
+ * a refresh token through the OAuth2 POST flow when it holds one, then tries
+ * the OAuth2 password grant when PasswordGrant is set, and finally falls back
+ * to the GET request with HTTP Basic auth every token server supports. A
+ * realm that rejects the password grant is not asked again.
+ *
+ * When every method fails, the response of the last one is returned.
+ */
+func (t *TokenTransport) auth(ctx context.Context, authService *authService, scopes scopeSet) (*cachedToken, *http.Response, error) {
+	var lastResp *http.Response
+	for _, grant := range t.grants(authService) {
+		authToken, response, err := t.fetchToken(ctx, grant, authService, scopes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if authToken == nil {
+			t.logger().Debug("registry.token.failed", "realm", authService.Realm, "grant", grant, "status", response.StatusCode)
+			t.grantFailed(authService, grant)
+			if lastResp != nil {
+				lastResp.Body.Close()
+			}
+			lastResp = response
+			continue
+		}
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+
+		if len(authToken.RefreshToken) > 0 {
+			t.setRefreshToken(authService.Realm, authToken.RefreshToken)
+		}
+		token := &cachedToken{
+			realm:   authService.Realm,
+			service: authService.Service,
+			scopes:  scopes,
+			token:   authToken.Token,
+			expires: tokenExpiry(authToken.IssuedAt, authToken.ExpiresIn),
+		}
+		if len(token.token) == 0 {
+			token.token = authToken.AccessToken
+		}
+		t.logger().Debug("registry.token", "realm", token.realm, "service", token.service, "grant", grant, "scope", strings.Join(scopes.strings(), " "), "expires", token.expires.Format(time.RFC3339))
+		t.store(token)
+		return token, nil, nil
+	}
+	return nil, lastResp, nil
+}
+
+func (t *TokenTransport) grants(authService *authService) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var grants []string
+	if len(t.refreshToken(authService.Realm)) > 0 {
+		grants = append(grants, grantRefreshToken)
+	}
+	if t.PasswordGrant && (t.Username != "" || t.Password != "") && !t.noPasswordGrant[authService.Realm] {
+		grants = append(grants, grantPassword)
+	}
+	return append(grants, grantBasic)
+}
+
+// fetchToken requests a token with grant. It returns the token, or the
+// response of the token server when it was refused.
+func (t *TokenTransport) fetchToken(ctx context.Context, grant string, authService *authService, scopes scopeSet) (*authToken, *http.Response, error) {
+	var authReq *http.Request
+	var err error
+	switch grant {
+	case grantRefreshToken:
+		t.mutex.Lock()
+		refreshToken := t.refreshToken(authService.Realm)
+		t.mutex.Unlock()
+		authReq, err = authService.OAuthRequest(url.Values{
+			"grant_type":    {grantRefreshToken},
+			"refresh_token": {refreshToken},
+		}, scopes)
+	case grantPassword:
+		authReq, err = authService.OAuthRequest(url.Values{
+			"grant_type":  {grantPassword},
+			"username":    {t.Username},
+			"password":    {t.Password},
+			"access_type": {"offline"},
+		}, scopes)
+	default:
+		authReq, err = authService.Request(t.Username, t.Password, scopes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := http.Client{
+		Transport: t.Transport,
+	}
+
+	response, err := client.Do(authReq.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, response, nil
+	}
+	defer response.Body.Close()
+
+	var authToken authToken
+	decoder := json.NewDecoder(response.Body)
+	err = decoder.Decode(&authToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(authToken.Token) == 0 && len(authToken.AccessToken) == 0 {
+		return nil, nil, errors.New("token response of " + authService.Realm + " has no token")
+	}
+	return &authToken, nil, nil
+}
+
+// grantFailed stops using a refresh token the realm refused, and the
+// password grant on a realm that does not support it.
+func (t *TokenTransport) grantFailed(authService *authService, grant string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch grant {
+	case grantRefreshToken:
+		t.setRefreshTokenLocked(authService.Realm, "")
+	case grantPassword:
+		if t.noPasswordGrant == nil {
+			t.noPasswordGrant = make(map[string]bool)
+		}
+		t.noPasswordGrant[authService.Realm] = true
+	}
+}
+
+// refreshToken returns the refresh token of realm, the identity token unless
+// the realm issued or refused one. The mutex must be held.
+func (t *TokenTransport) refreshToken(realm string) string {
+	if refreshToken, ok := t.refreshTokens[realm]; ok {
+		return refreshToken
+	}
+	return t.IdentityToken
+}
+
+func (t *TokenTransport) setRefreshToken(realm string, refreshToken string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.setRefreshTokenLocked(realm, refreshToken)
+}
+
+func (t *TokenTransport) setRefreshTokenLocked(realm string, refreshToken string) {
+	if t.refreshTokens == nil {
+		t.refreshTokens = make(map[string]string)
+	}
+	t.refreshTokens[realm] = refreshToken
+}
+
+func (t *TokenTransport) retry(req *http.Request, token *cachedToken) (*http.Response, error) {
+	retryReq := withToken(req, token)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retryReq.Body = body
+	}
+	resp, err := t.Transport.RoundTrip(retryReq)
+	return resp, err
+}
+
+// withToken returns a copy of req authorized with token, or req itself when
+// there is no token.
+func withToken(req *http.Request, token *cachedToken) *http.Request {
+	if token == nil {
+		return req
+	}
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.token))
+	return authorized
+}
+
+// tokenExpiry returns when a token issued at issuedAt and valid for expiresIn
+// seconds must be renewed.
+func tokenExpiry(issuedAt time.Time, expiresIn int) time.Time {
+	lifetime := DefaultTokenExpiry
+	if expiresIn > 0 {
+		lifetime = time.Duration(expiresIn) * time.Second
+	}
+	now := time.Now()
+	if issuedAt.IsZero() || issuedAt.After(now) {
+		issuedAt = now
+	}
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	return issuedAt.Add(lifetime)
+}
+
+func (t *TokenTransport) challenge(host string) *authService {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.challenges[host]
+}
+
+func (t *TokenTransport) setChallenge(host string, service *authService) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.challenges == nil {
+		t.challenges = make(map[string]*authService)
+	}
+	t.challenges[host] = service
+}
+
+// cachedToken returns an unexpired token of the realm and service of
+// authService whose scopes cover scopes.
+func (t *TokenTransport) cachedToken(authService *authService, scopes scopeSet) *cachedToken {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	valid := t.tokens[:0]
+	var found *cachedToken
+	for _, token := range t.tokens {
+		if now.After(token.expires) {
+			continue
+		}
+		valid = append(valid, token)
+		if found == nil && token.realm == authService.Realm && token.service == authService.Service && token.scopes.covers(scopes) {
+			found = token
+		}
+	}
+	t.tokens = valid
+	return found
+}
+
+func (t *TokenTransport) store(token *cachedToken) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tokens = append(t.tokens, token)
+}
+
+func (t *TokenTransport) invalidate(token *cachedToken) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, cached := range t.tokens {
+		if cached == token {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *TokenTransport) logger() *logging.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return logging.Default()
+}
+
+type authService struct {
+	Realm   string
+	Service string
+	Scopes  scopeSet
+}
+
+func (authService *authService) Request(username, password string, scopes scopeSet) (*http.Request, error) {
+	url, err := url.Parse(authService.Realm)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Query()
+	q.Set("service", authService.Service)
+	for _, scope := range scopes.strings() {
+		q.Add("scope", scope)
+	}
+	url.RawQuery = q.Encode()
+
+	request, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" || password != "" {
+		request.SetBasicAuth(username, password)
+	}
+
+	return request, err
+}
+
+// clientID identifies this tool to token servers in the OAuth2 flow.
+const clientID = "docker-registry-importer"
+
+func (authService *authService) OAuthRequest(form url.Values, scopes scopeSet) (*http.Request, error) {
+	form.Set("service", authService.Service)
+	form.Set("client_id", clientID)
+	if len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes.strings(), " "))
+	}
+
+	request, err := http.NewRequest("POST", authService.Realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
+
+func isTokenDemand(resp *http.Response) *authService {
+	if resp == nil {
+		return nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	return parseOauthHeader(resp)
+}
+
+func parseOauthHeader(resp *http.Response) *authService {
+	challenges := parseAuthHeader(resp.Header)
+	for _, challenge := range challenges {
+		if challenge.Scheme == "bearer" {
+			return &authService{
+				Realm:   challenge.Parameters["realm"],
+				Service: challenge.Parameters["service"],
+				Scopes:  parseScopes(strings.Fields(challenge.Parameters["scope"])),
+			}
+		}
+	}
+	return nil
+}
+
+// scopeSet maps a resource such as "repository:library/alpine" to the actions
+// granted on it.
+type scopeSet map[string]map[string]bool
+
+// parseScopes parses scopes of the form "type:name:action[,action]".
+func parseScopes(scopes []string) scopeSet {
+	set := make(scopeSet)
+	for _, scope := range scopes {
+		index := strings.LastIndex(scope, ":")
+		if index <= 0 {
+			continue
+		}
+		set.add(scope[:index], strings.Split(scope[index+1:], ",")...)
+	}
+	return set
+}
+
+func (s scopeSet) add(resource string, actions ...string) {
+	if s[resource] == nil {
+		s[resource] = make(map[string]bool)
+	}
+	for _, action := range actions {
+		if len(action) > 0 {
+			s[resource][action] = true
+		}
+	}
+}
+
+// merge returns the union of s and other.
+func (s scopeSet) merge(other scopeSet) scopeSet {
+	merged := make(scopeSet)
+	for _, set := range []scopeSet{s, other} {
+		for resource, actions := range set {
+			merged.add(resource)
+			for action := range actions {
+				merged.add(resource, action)
+			}
+		}
+	}
+	return merged
+}
+
+// covers reports whether every action of other is granted by s.
+func (s scopeSet) covers(other scopeSet) bool {
+	for resource, actions := range other {
+		granted := s[resource]
+		for action := range actions {
+			if !granted[action] && !granted["*"] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s scopeSet) strings() []string {
+	scopes := make([]string, 0, len(s))
+	for resource, actions := range s {
+		names := make([]string, 0, len(actions))
+		for action := range actions {
+			names = append(names, action)
+		}
+		sort.Strings(names)
+		scopes = append(scopes, resource+":"+strings.Join(names, ","))
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+var repositoryPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/`)
+
+// requestScopes returns the scopes req needs: pull on its repository for
+// reads, pull and push for writes, and pull on the source of a blob mount.
+func requestScopes(req *http.Request) scopeSet {
+	scopes := make(scopeSet)
+	if req.URL.Path == "/v2/_catalog" {
+		scopes.add("registry:catalog", "*")
+		return scopes
+	}
+	match := repositoryPath.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		return scopes
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		scopes.add("repository:"+match[1], "pull")
+	case http.MethodDelete:
+		if strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			// Cancelling an upload is part of pushing.
+			scopes.add("repository:"+match[1], "pull", "push")
+		} else {
+			scopes.add("repository:"+match[1], "delete")
+		}
+	default:
+		scopes.add("repository:"+match[1], "pull", "push")
+	}
+	if from := req.URL.Query().Get("from"); len(from) > 0 {
+		scopes.add("repository:"+from, "pull")
+	}
+	return scopes
+}
@@ -0,0 +1,274 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is a registry demanding bearer tokens, which it issues at
+// /token. It logs the requests it answers, such as "GET /v2/a/manifests/v1
+// t1" or "POST /token refresh_token=r1".
+type tokenServer struct {
+	*httptest.Server
+	// postStatus answers the POST token requests when it is not zero.
+	postStatus int
+	// field holds the token in the token responses: token or access_token.
+	field        string
+	refreshToken string
+	expiresIn    int
+	issuedAt     time.Time
+
+	mutex    sync.Mutex
+	requests []string
+	issued   int
+	valid    map[string]bool
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	s := &tokenServer{field: "token", valid: make(map[string]bool)}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path == "/token" {
+		s.token(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.requests = append(s.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+token))
+	if !s.valid[token] {
+		repository := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v2/"), "/", 2)[0]
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, s.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+}
+
+func (s *tokenServer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		_ = r.ParseForm()
+		request := "POST /token grant_type=" + r.PostForm.Get("grant_type")
+		if refreshToken := r.PostForm.Get("refresh_token"); len(refreshToken) > 0 {
+			request += " refresh_token=" + refreshToken
+		}
+		if username := r.PostForm.Get("username"); len(username) > 0 {
+			request += " username=" + username
+		}
+		s.requests = append(s.requests, request)
+		if s.postStatus != 0 {
+			w.WriteHeader(s.postStatus)
+			return
+		}
+	} else if username, _, ok := r.BasicAuth(); ok {
+		s.requests = append(s.requests, "GET /token user="+username)
+	} else {
+		s.requests = append(s.requests, "GET /token")
+	}
+
+	s.issued++
+	token := fmt.Sprintf("t%d", s.issued)
+	s.valid[token] = true
+	response := map[string]interface{}{s.field: token}
+	if len(s.refreshToken) > 0 {
+		response["refresh_token"] = s.refreshToken
+	}
+	if s.expiresIn > 0 {
+		response["expires_in"] = s.expiresIn
+	}
+	if !s.issuedAt.IsZero() {
+		response["issued_at"] = s.issuedAt
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// log returns the requests answered so far and forgets them.
+func (s *tokenServer) log() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+}
+
+func TestTokenTransportUpFront(t *testing.T) {
+	s := newTokenServer(t)
+	client := &http.Client{Transport: &TokenTransport{Transport: http.DefaultTransport}}
+
+	get(t, client, s.URL+"/v2/a/manifests/v1")
+	get(t, client, s.URL+"/v2/a/manifests/v2")
+	get(t, client, s.URL+"/v2/b/manifests/v1")
+
+	// A body without GetBody cannot be sent again after a 401: it must go
+	// with a token.
+	req, err := http.NewRequest(http.MethodPut, s.URL+"/v2/c/manifests/v1", io.NopCloser(strings.NewReader("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT: status %d", resp.StatusCode)
+	}
+
+	want := []string{
+		"GET /v2/a/manifests/v1",
+		"GET /token",
+		"GET /v2/a/manifests/v1 t1",
+		"GET /v2/a/manifests/v2 t1",
+		"GET /token",
+		"GET /v2/b/manifests/v1 t2",
+		"GET /token",
+		"PUT /v2/c/manifests/v1 t3",
+	}
+	if got := s.log(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestTokenTransportGrants(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    func(s *tokenServer)
+		transport *TokenTransport
+		// repositories are pulled in turn, from v1 manifests.
+		repositories []string
+		want         []string
+	}{
+		{
+			name:         "access_token is accepted in place of token",
+			server:       func(s *tokenServer) { s.field = "access_token" },
+			repositories: []string{"a"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"GET /token",
+				"GET /v2/a/manifests/v1 t1",
+			},
+		},
+		{
+			name:         "identity token is exchanged, then the refresh token issued",
+			server:       func(s *tokenServer) { s.refreshToken = "r1" },
+			transport:    &TokenTransport{Username: "alice", IdentityToken: "identity"},
+			repositories: []string{"a", "b"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"POST /token grant_type=refresh_token refresh_token=identity",
+				"GET /v2/a/manifests/v1 t1",
+				"POST /token grant_type=refresh_token refresh_token=r1",
+				"GET /v2/b/manifests/v1 t2",
+			},
+		},
+		{
+			name:         "POST answered with 404 falls back to GET",
+			server:       func(s *tokenServer) { s.postStatus = http.StatusNotFound },
+			transport:    &TokenTransport{Username: "alice", IdentityToken: "identity"},
+			repositories: []string{"a", "b"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"POST /token grant_type=refresh_token refresh_token=identity",
+				"GET /token user=alice",
+				"GET /v2/a/manifests/v1 t1",
+				"GET /token user=alice",
+				"GET /v2/b/manifests/v1 t2",
+			},
+		},
+		{
+			name:         "POST answered with 405 falls back to GET",
+			server:       func(s *tokenServer) { s.postStatus = http.StatusMethodNotAllowed },
+			transport:    &TokenTransport{Username: "alice", Password: "secret", PasswordGrant: true},
+			repositories: []string{"a", "b"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"POST /token grant_type=password username=alice",
+				"GET /token user=alice",
+				"GET /v2/a/manifests/v1 t1",
+				"GET /token user=alice",
+				"GET /v2/b/manifests/v1 t2",
+			},
+		},
+		{
+			name:         "password grant is not used by default",
+			transport:    &TokenTransport{Username: "alice", Password: "secret"},
+			repositories: []string{"a"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"GET /token user=alice",
+				"GET /v2/a/manifests/v1 t1",
+			},
+		},
+		{
+			name:         "password grant is used with PasswordGrant",
+			transport:    &TokenTransport{Username: "alice", Password: "secret", PasswordGrant: true},
+			repositories: []string{"a"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"POST /token grant_type=password username=alice",
+				"GET /v2/a/manifests/v1 t1",
+			},
+		},
+		{
+			name: "token is renewed once expires_in runs out",
+			server: func(s *tokenServer) {
+				s.expiresIn = 60
+				s.issuedAt = time.Now().Add(-2 * time.Minute)
+			},
+			repositories: []string{"a", "a"},
+			want: []string{
+				"GET /v2/a/manifests/v1",
+				"GET /token",
+				"GET /v2/a/manifests/v1 t1",
+				"GET /token",
+				"GET /v2/a/manifests/v1 t2",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTokenServer(t)
+			if test.server != nil {
+				test.server(s)
+			}
+			transport := test.transport
+			if transport == nil {
+				transport = &TokenTransport{}
+			}
+			transport.Transport = http.DefaultTransport
+			client := &http.Client{Transport: transport}
+			for _, repository := range test.repositories {
+				get(t, client, s.URL+"/v2/"+repository+"/manifests/v1")
+			}
+			if got := s.log(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("requests:\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
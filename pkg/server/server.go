@@ -0,0 +1,294 @@
+/*
+ * Package server serves images over the read-only part of the distribution
+ * API, so that docker, containerd and other registry clients can pull them.
+ */
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/jc-lab/docker-registry-importer/pkg/copier"
+	"github.com/jc-lab/docker-registry-importer/pkg/logging"
+	"github.com/jc-lab/docker-registry-importer/pkg/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// Backend holds the images a Server serves. copier.ArchiveSource is one.
+type Backend interface {
+	copier.Source
+	// Repositories lists the repositories, sorted.
+	Repositories(c context.Context) ([]string, error)
+	// Tags lists the tags of repository, sorted. It fails with an error
+	// matching copier.IsNotFound for an unknown repository.
+	Tags(c context.Context, repository string) ([]string, error)
+}
+
+// BlobStater is a Backend that can tell the size of a blob without opening
+// it, which the Server does to answer HEAD requests.
+type BlobStater interface {
+	// StatBlob returns the descriptor of the blob of digest d in repository.
+	// It fails with an error matching copier.IsNotFound for an unknown blob.
+	StatBlob(c context.Context, repository string, d digest.Digest) (distribution.Descriptor, error)
+}
+
+/*
+ * Server is an http.Handler serving the images of Backend:
+ *
+ *	GET /v2/
+ *	GET /v2/_catalog
+ *	GET /v2/NAME/tags/list
+ *	GET, HEAD /v2/NAME/manifests/REFERENCE
+ *	GET, HEAD /v2/NAME/blobs/DIGEST, with Range requests
+ *
+ * Lists are paginated with the n and last parameters. Every other request is
+ * refused as UNSUPPORTED.
+ */
+type Server struct {
+	Backend Backend
+	// Logger receives a debug entry for every request; nil means
+	// logging.Default().
+	Logger *logging.Logger
+	// Namespaces prefixes repositories with the ns parameter containerd
+	// sends to mirrors, the registry they mirror, as in
+	// docker.io/library/alpine.
+	Namespaces bool
+}
+
+// startTime is the modification time of everything served, for the
+// conditional requests of http.ServeContent.
+var startTime = time.Now()
+
+func (s *Server) logger() *logging.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return logging.Default()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.serve(recorder, r)
+	s.logger().Debug("serve."+strings.ToLower(r.Method), "url", r.URL.String(), "status", recorder.status, "remote", r.RemoteAddr)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, registry.ErrUnsupported, "the registry is read-only")
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2/" || path == "/v2":
+		writeJSON(w, r, struct{}{})
+	case path == "/v2/_catalog":
+		s.catalog(w, r)
+	case !strings.HasPrefix(path, "/v2/"):
+		writeError(w, http.StatusNotFound, registry.ErrNameUnknown, "not a distribution API path")
+	case strings.HasSuffix(path, "/tags/list"):
+		s.tags(w, r, s.repository(r, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list")))
+	default:
+		repository, kind, reference, ok := splitPath(strings.TrimPrefix(path, "/v2/"))
+		repository = s.repository(r, repository)
+		if !ok {
+			writeError(w, http.StatusNotFound, registry.ErrNameUnknown, "not a distribution API path")
+		} else if kind == "manifests" {
+			s.manifest(w, r, repository, reference)
+		} else {
+			s.blob(w, r, repository, reference)
+		}
+	}
+}
+
+// repository returns the repository of the request for the repository of
+// its path.
+func (s *Server) repository(r *http.Request, repository string) string {
+	if ns := r.URL.Query().Get("ns"); s.Namespaces && len(ns) > 0 {
+		return ns + "/" + repository
+	}
+	return repository
+}
+
+// splitPath splits NAME/manifests/REFERENCE or NAME/blobs/DIGEST.
+func splitPath(path string) (string, string, string, bool) {
+	for _, kind := range []string{"manifests", "blobs"} {
+		index := strings.LastIndex(path, "/"+kind+"/")
+		if index > 0 {
+			reference := path[index+len(kind)+2:]
+			if len(reference) > 0 && !strings.Contains(reference, "/") {
+				return path[:index], kind, reference, true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+func (s *Server) catalog(w http.ResponseWriter, r *http.Request) {
+	repositories, err := s.Backend.Repositories(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	repositories = paginate(w, r, repositories)
+	writeJSON(w, r, struct {
+		Repositories []string `json:"repositories"`
+	}{repositories})
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request, repository string) {
+	tags, err := s.Backend.Tags(r.Context(), repository)
+	if copier.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, registry.ErrNameUnknown, "repository not found: "+repository)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	tags = paginate(w, r, tags)
+	writeJSON(w, r, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{repository, tags})
+}
+
+// paginate returns the page of sorted values the n and last parameters of r
+// ask for, and links the next page.
+func paginate(w http.ResponseWriter, r *http.Request, values []string) []string {
+	query := r.URL.Query()
+	if last := query.Get("last"); len(last) > 0 {
+		start := 0
+		for start < len(values) && values[start] <= last {
+			start++
+		}
+		values = values[start:]
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil || n <= 0 || n >= len(values) {
+		return values
+	}
+	values = values[:n]
+	next := *r.URL
+	query.Set("last", values[n-1])
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	return values
+}
+
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request, repository, reference string) {
+	mediaType, payload, err := s.Backend.Manifest(r.Context(), repository, reference)
+	if copier.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, registry.ErrManifestUnknown, "manifest unknown: "+repository+" "+reference)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	d := digest.FromBytes(payload)
+	if expected, err := digest.Parse(reference); err == nil {
+		d = expected
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Etag", `"`+d.String()+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(payload)
+}
+
+func (s *Server) blob(w http.ResponseWriter, r *http.Request, repository, reference string) {
+	d, err := digest.Parse(reference)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, registry.ErrDigestInvalid, err.Error())
+		return
+	}
+	if stater, ok := s.Backend.(BlobStater); ok && r.Method == http.MethodHead {
+		s.statBlob(w, r, stater, repository, d)
+		return
+	}
+	content, err := s.Backend.Blob(r.Context(), repository, distribution.Descriptor{Digest: d})
+	if copier.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, registry.ErrBlobUnknown, "blob unknown: "+d.String())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Etag", `"`+d.String()+`"`)
+	w.Header().Set("Cache-Control", "max-age=31536000")
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", startTime, seeker)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, content)
+}
+
+func (s *Server) statBlob(w http.ResponseWriter, r *http.Request, stater BlobStater, repository string, d digest.Digest) {
+	desc, err := stater.StatBlob(r.Context(), repository, d)
+	if copier.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, registry.ErrBlobUnknown, "blob unknown: "+d.String())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Etag", `"`+d.String()+`"`)
+	w.Header().Set("Cache-Control", "max-age=31536000")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// writeError answers with a distribution error body.
+func writeError(w http.ResponseWriter, status int, code registry.ErrorCode, message string) {
+	if len(code) == 0 {
+		code = "UNKNOWN"
+	}
+	data, _ := json.Marshal(struct {
+		Errors []*registry.Error `json:"errors"`
+	}{[]*registry.Error{{Code: code, Message: message}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}